@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -15,61 +16,191 @@ import (
 	_ "github.com/johnweldon/consolidate/storage/sqlite"
 )
 
-func appMain(c *cli.Context) error {
+// addMain backs up the source folders into the repository and records
+// the run as a snapshot
+func addMain(c *cli.Context) error {
 	from := c.StringSlice("source")
 	if len(from) < 1 {
-		if err := cli.ShowAppHelp(c); err != nil {
+		if err := cli.ShowCommandHelp(c, "add"); err != nil {
 			return err
 		}
-		return fmt.Errorf("no source folders specified")
+		return usageError(fmt.Errorf("no source folders specified"))
+	}
+	// a missing source, such as an unmounted drive, must not be recorded
+	// as a snapshot of nothing, which forget would then keep in place of
+	// the real ones
+	for _, dir := range from {
+		if stat, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("source %q: %v", dir, err)
+		} else if !stat.IsDir() {
+			return fmt.Errorf("source %q is not a folder", dir)
+		}
 	}
 
+	codec, err := storage.ParseCodec(c.String("compression"))
+	if err != nil {
+		return usageError(err)
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	if algo := repo.HashAlgorithm(); !algo.Writable() {
+		return fmt.Errorf("repository uses %s content ids and is read only; add to a new repository instead", algo)
+	}
+
+	snap, err := storage.NewSnapshot(nil)
+	if err != nil {
+		return err
+	}
+	snap.Tags = c.StringSlice("snapshot-tag")
+
 	out, e, quit := make(chan string), make(chan error), make(chan interface{})
-	lctx := logContext{C: c, O: out, E: e, Q: quit}
-	ctx := appContext{C: c, R: factory.Registry.Create("sqlite"), O: out, E: e}
+	lctx := logContext{C: c, O: out, E: e, Q: quit, Errors: new(int)}
+	ctx := appContext{C: c, R: repo, O: out, E: e, Seen: &seenFiles{files: snap.Files}}
+	ctx.Opts = storage.DefaultOptions()
+	ctx.Opts.Hash = ctx.R.HashAlgorithm()
+	ctx.Opts.Compression = codec
+	if enc, ok := ctx.R.(storage.Encryptable); ok {
+		ctx.Opts.Key = enc.Key()
+	}
+	if cache, ok := ctx.R.(storage.StatCache); ok {
+		ctx.Cache = cache
+	}
+	ctx.Rehash = c.Bool("rehash")
 
 	go lctx.logger()
 
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := []string{}
 	for _, dir := range from {
-		if stat, err := os.Stat(dir); err != nil {
-			e <- fmt.Errorf("error %q: %v", dir, err)
-			continue
-		} else if !stat.IsDir() {
-			e <- fmt.Errorf("%q is not a folder", dir)
-			continue
-		}
+		snap.Roots = append(snap.Roots, filepath.ToSlash(filepath.Clean(dir)))
 		wg.Add(1)
 		go func(begin string) {
 			defer wg.Done()
 			if err := filepath.Walk(begin, ctx.visitor(begin)); err != nil {
 				e <- err
+				mu.Lock()
+				failed = append(failed, begin)
+				mu.Unlock()
 			}
 		}(dir)
 	}
 	wg.Wait()
 
+	if len(failed) > 0 {
+		err = fmt.Errorf("no snapshot recorded: could not read %s", strings.Join(failed, ", "))
+	} else if err = repo.AddSnapshot(snap); err != nil {
+		err = fmt.Errorf("saving snapshot: %v", err)
+	} else {
+		out <- fmt.Sprintf("snapshot %s: %d files", snap.ID, len(snap.Files))
+	}
+
 	quit <- nil
 	close(e)
 	close(out)
 	close(quit)
 
-	if c.Bool("verbose") {
+	if c.GlobalBool("verbose") {
 		fmt.Printf("\nNAMES: %v\n\n", ctx.R.AllNames())
 		fmt.Printf(" TAGS: %v\n\n", ctx.R.AllTags())
 	}
+	if err != nil {
+		return err
+	}
+	if *lctx.Errors > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d error(s) while adding", *lctx.Errors), exitFailure)
+	}
 	return nil
 }
 
+// parseNewHash reads the content id hash for a new repository, which must
+// be one new content can be stored under
+func parseNewHash(name string) (storage.HashAlgorithm, error) {
+	algo, err := storage.ParseHashAlgorithm(name)
+	if err == nil && !algo.Writable() {
+		err = fmt.Errorf("%s only opens old repositories; new ones use sha256 or sha512/256", algo)
+	}
+	return algo, err
+}
+
+// openRepository opens the repository and unseals it if it is encrypted
+func openRepository(c *cli.Context) (storage.Repository, error) {
+	name, opts, err := factory.ParseDSN(c.GlobalString("repo"))
+	if err != nil {
+		return nil, usageError(err)
+	}
+	if hash := c.GlobalString("hash"); hash != "" {
+		if opts.Hash, err = parseNewHash(hash); err != nil {
+			return nil, usageError(err)
+		}
+	}
+	repo, err := factory.Registry.Create(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if got := repo.HashAlgorithm(); opts.Hash != "" && got != "" && got != opts.Hash {
+		return nil, fmt.Errorf("repository uses %s content ids, not %s", got, opts.Hash)
+	}
+	if err = unseal(c, repo); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// unseal unlocks an encrypted repository, or encrypts a new one when asked
+func unseal(c *cli.Context, r storage.Repository) error {
+	enc, ok := r.(storage.Encryptable)
+	if !ok {
+		if c.GlobalBool("encrypt") {
+			return fmt.Errorf("repository does not support encryption")
+		}
+		return nil
+	}
+	if !enc.Encrypted() && !c.GlobalBool("encrypt") {
+		return nil
+	}
+
+	passphrase, err := readPassphrase(c)
+	if err != nil {
+		return err
+	}
+	if enc.Encrypted() {
+		return enc.Unseal(passphrase)
+	}
+	return enc.Encrypt(passphrase, c.GlobalBool("encrypt-names"))
+}
+
+// readPassphrase takes the passphrase from --passphrase-file, or else from
+// the CONSOLIDATE_PASSPHRASE environment variable
+func readPassphrase(c *cli.Context) ([]byte, error) {
+	if file := c.GlobalString("passphrase-file"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(b), "\r\n")), nil
+	}
+	if p := os.Getenv("CONSOLIDATE_PASSPHRASE"); p != "" {
+		return []byte(p), nil
+	}
+	return nil, fmt.Errorf("no passphrase: set CONSOLIDATE_PASSPHRASE or --passphrase-file")
+}
+
 type logContext struct {
 	C *cli.Context
 	O <-chan string
 	E <-chan error
 	Q <-chan interface{}
+	// Errors counts what came in on E; it is only read once the logger
+	// has taken its quit
+	Errors *int
 }
 
 func (c logContext) logger() {
-	verbose := c.C.Bool("verbose")
+	verbose := c.C.GlobalBool("verbose")
 
 	for {
 		select {
@@ -80,6 +211,7 @@ func (c logContext) logger() {
 		case err := <-c.E:
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERR: %v\n", err)
+				*c.Errors++
 			}
 		case <-c.Q:
 			if verbose {
@@ -91,29 +223,95 @@ func (c logContext) logger() {
 }
 
 type appContext struct {
-	C *cli.Context
-	R storage.Repository
-	O chan<- string
-	E chan<- error
+	C    *cli.Context
+	R    storage.Repository
+	O    chan<- string
+	E    chan<- error
+	Opts storage.Options
+	Seen *seenFiles
+	// Cache, when the repository has one, lets unchanged files be skipped
+	// unless Rehash asks for every file to be read
+	Cache  storage.StatCache
+	Rehash bool
+}
+
+// seenFiles collects the content of every path added during a run
+type seenFiles struct {
+	sync.Mutex
+	files map[string]storage.ID
+}
+
+func (s *seenFiles) add(name string, id storage.ID) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[name] = id
 }
 
 func (c appContext) visitor(root string) func(string, os.FileInfo, error) error {
 	exclude := c.C.StringSlice("exclude")
 
-	return func(path string, f os.FileInfo, e error) error {
+	return func(file string, f os.FileInfo, e error) error {
+		if e != nil {
+			// a root that cannot be read fails the whole walk; anything
+			// below it is only reported
+			if file == root {
+				return e
+			}
+			c.E <- e
+			return nil
+		}
 		if f.IsDir() {
 			return nil
 		}
 		for _, ex := range exclude {
-			if strings.Contains(path, ex) {
+			if strings.Contains(file, ex) {
 				return nil
 			}
 		}
-		if err := c.R.AddFile(path, root); err != nil {
+		st := storage.NewFileStat(f)
+		if id, ok := c.cachedID(file, f, st); ok {
+			c.Seen.add(path.Clean(file), id)
+			c.O <- "unchanged: " + file
+			return nil
+		}
+		name, id, err := c.add(file, root)
+		if err != nil {
 			c.E <- err
 			return nil
 		}
-		c.O <- "added: " + path
+		c.Seen.add(name, id)
+		c.O <- "added: " + file
+		// the stat is the one from before the file was read, so a write
+		// made while reading it shows up as a change next time
+		if c.Cache != nil && f.Mode().IsRegular() {
+			if err = c.Cache.CacheStat(name, st, id); err != nil {
+				c.E <- fmt.Errorf("caching stat of %q: %v", file, err)
+			}
+		}
 		return nil
 	}
 }
+
+// cachedID returns the content id the stat cache holds for file if it has
+// not changed since it was last read. Only regular files are looked up,
+// since the stat of a link says nothing of what it points to
+func (c appContext) cachedID(file string, f os.FileInfo, st storage.FileStat) (storage.ID, bool) {
+	if c.Cache == nil || c.Rehash || !f.Mode().IsRegular() {
+		return "", false
+	}
+	return c.Cache.CachedID(path.Clean(file), st)
+}
+
+// add stores a file and returns the name it was recorded under along
+// with its content id
+func (c appContext) add(path, root string) (string, storage.ID, error) {
+	obj, err := storage.NewObject(path, root, c.Opts)
+	if err != nil {
+		return "", "", err
+	}
+	defer obj.Close()
+	if err = c.R.Add(obj); err != nil {
+		return "", "", err
+	}
+	return obj.Names()[0], obj.Hash(), nil
+}
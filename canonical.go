@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// defaultRules choose a canonical name when no --rule is given
+var defaultRules = []string{"no-copy", "oldest", "shortest"}
+
+func canonicalMain(c *cli.Context) error {
+	specs := c.StringSlice("rule")
+	if len(specs) == 0 {
+		specs = defaultRules
+	}
+	rules, err := storage.ParseRules(specs)
+	if err != nil {
+		return usageError(err)
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+
+	objects, err := allObjects(repo)
+	if err != nil {
+		return err
+	}
+
+	dryRun, verbose := c.Bool("dry-run"), c.GlobalBool("verbose")
+	var chosen, changed, failed int
+	for _, obj := range objects {
+		entries := obj.Entries()
+		if len(entries) < 2 {
+			continue
+		}
+		chosen++
+		best, _ := rules.Choose(entries)
+		if best.Name == obj.Canonical() {
+			continue
+		}
+		if dryRun || verbose {
+			fmt.Printf("%s  %s\n", obj.Hash(), best.Name)
+		}
+		if !dryRun {
+			if err = repo.SetCanonical(obj.Hash(), best.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "ERR: %s: %v\n", obj.Hash(), err)
+				failed++
+				continue
+			}
+		}
+		changed++
+	}
+
+	verb := "changed"
+	if dryRun {
+		verb = "would change"
+	}
+	fmt.Printf("%d group(s), %s %d canonical name(s)\n", chosen, verb, changed)
+	if failed > 0 {
+		return fmt.Errorf("%d canonical name(s) could not be recorded", failed)
+	}
+	return nil
+}
+
+// canonicalOf returns the canonical name of o if it is one of names,
+// and "" otherwise
+func canonicalOf(o storage.Object, names []string) string {
+	if name := o.Canonical(); name != "" && hasString(names, name) {
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+
+	"github.com/johnweldon/consolidate/storage"
+	"github.com/johnweldon/consolidate/storage/factory"
+)
+
+// configNames are looked for in the working directory, then in the
+// consolidate folder of the user's config directory, then in
+// /etc/consolidate
+var configNames = []string{"consolidate.toml", "consolidate.yaml", "consolidate.yml"}
+
+// setting is a key of a config file and the flag it gives a value to
+type setting struct {
+	flag  string
+	kind  string // list, string, int or bool
+	check func(value string) error
+}
+
+// globalSettings may appear at the top of a config file and in profiles;
+// they fill in the global flags and those of the command run, such as the
+// sources of add
+var globalSettings = map[string]setting{
+	"sources":         {"source", "list", nil},
+	"excludes":        {"exclude", "list", nil},
+	"snapshot-tags":   {"snapshot-tag", "list", nil},
+	"repo":            {"repo", "string", checkDSN},
+	"compression":     {"compression", "string", checkCodec},
+	"hash":            {"hash", "string", checkHash},
+	"passphrase-file": {"passphrase-file", "string", nil},
+}
+
+// retentionSettings belong in a retention table and fill in the flags of
+// forget
+var retentionSettings = map[string]setting{
+	"keep-last":    {"keep-last", "int", nil},
+	"keep-daily":   {"keep-daily", "int", nil},
+	"keep-weekly":  {"keep-weekly", "int", nil},
+	"keep-monthly": {"keep-monthly", "int", nil},
+	"keep-yearly":  {"keep-yearly", "int", nil},
+	"keep-within":  {"keep-within", "string", checkAge},
+	"keep-tags":    {"keep-tag", "list", nil},
+	"prune":        {"prune", "bool", nil},
+}
+
+func checkDSN(v string) error   { _, _, err := factory.ParseDSN(v); return err }
+func checkCodec(v string) error { _, err := storage.ParseCodec(v); return err }
+func checkHash(v string) error  { _, err := parseNewHash(v); return err }
+func checkAge(v string) error   { _, err := parseAge(v); return err }
+
+// config holds what a config file sets, as flag values by flag name
+type config struct {
+	file      string
+	global    map[string][]string
+	retention map[string][]string
+}
+
+func newConfig(file string) *config {
+	return &config{file: file, global: map[string][]string{}, retention: map[string][]string{}}
+}
+
+// withConfig runs fn once the config file has filled in the flags the
+// command line and environment leave unset, both the global ones and
+// those of the command. A bad config file is a usage error
+func withConfig(fn func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if err := loadConfig(c); err != nil {
+			return usageError(err)
+		}
+		return fn(c)
+	}
+}
+
+// loadConfig reads the config file for the command c runs
+func loadConfig(c *cli.Context) error {
+	file := c.GlobalString("config")
+	if file == "" {
+		if file = findConfig(); file == "" {
+			if profile := c.GlobalString("profile"); profile != "" {
+				return fmt.Errorf("no config file holds profile %q", profile)
+			}
+			return nil
+		}
+	}
+	cfg, err := readConfig(file, c.GlobalString("profile"))
+	if err != nil {
+		return err
+	}
+	if err = cfg.apply(c, cfg.global); err != nil {
+		return err
+	}
+	return cfg.apply(c, cfg.retention)
+}
+
+// apply sets every flag of values that is not set yet under any of its
+// names, looking for it first among the global flags and then among those
+// of the command; a setting neither has, such as sources for find, is left
+// for the commands that use it
+func (cfg *config) apply(c *cli.Context, values map[string][]string) error {
+	for flag, vals := range values {
+		ctx, names := c.Parent(), flagNames(c.App.Flags, flag)
+		if names == nil {
+			ctx, names = c, flagNames(c.Command.Flags, flag)
+		}
+		if names == nil || isSet(ctx, names) {
+			continue
+		}
+		for _, v := range vals {
+			if err := ctx.Set(flag, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", cfg.file, flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagNames returns every name of the flag among flags called name, or nil
+func flagNames(flags []cli.Flag, name string) []string {
+	for _, f := range flags {
+		names := strings.Split(f.GetName(), ",")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+		if names[0] == name {
+			return names
+		}
+	}
+	return nil
+}
+
+// isSet reports whether c has a flag by any of its names, as the command
+// line may give it by another name than the config file
+func isSet(c *cli.Context, names []string) bool {
+	for _, n := range names {
+		if c.IsSet(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func findConfig() string {
+	dirs := []string{"."}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "consolidate"))
+	}
+	dirs = append(dirs, "/etc/consolidate")
+	for _, dir := range dirs {
+		for _, name := range configNames {
+			file := filepath.Join(dir, name)
+			if fi, err := os.Stat(file); err == nil && !fi.IsDir() {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+// readConfig reads a TOML or YAML config file, laying the settings of
+// profile over those at the top. Every profile is checked, so that a
+// mistake shows up before the day it is used. The altsrc loaders of cli
+// are not used: they cannot read TOML lists, only look up keys by full
+// flag name and are built on another copy of the cli package
+func readConfig(file, profile string) (*config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		_, err = toml.Decode(string(b), &tree)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &tree)
+	default:
+		return nil, fmt.Errorf("%s: want a .toml, .yaml or .yml file", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	cfg := newConfig(file)
+	profiles := map[string]*config{}
+	for _, key := range sortedKeys(tree) {
+		if key != "profiles" {
+			if err = cfg.read(key, key, tree[key]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		t, ok := table(tree[key])
+		if !ok {
+			return nil, fmt.Errorf("%s: profiles: want a table of profiles", file)
+		}
+		for _, name := range sortedKeys(t) {
+			p, ok := table(t[name])
+			if !ok {
+				return nil, fmt.Errorf("%s: profiles.%s: want a table", file, name)
+			}
+			profiles[name] = newConfig(file)
+			for _, k := range sortedKeys(p) {
+				if err = profiles[name].read("profiles."+name+"."+k, k, p[k]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if profile == "" {
+		return cfg, nil
+	}
+	p, ok := profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("%s: no profile %q", file, profile)
+	}
+	for flag, vals := range p.global {
+		cfg.global[flag] = vals
+	}
+	for flag, vals := range p.retention {
+		cfg.retention[flag] = vals
+	}
+	return cfg, nil
+}
+
+// read records the setting key, found in the file at path
+func (cfg *config) read(path, key string, v interface{}) error {
+	if key != "retention" {
+		s, ok := globalSettings[key]
+		if !ok {
+			return fmt.Errorf("%s: %s: unknown setting", cfg.file, path)
+		}
+		vals, err := s.values(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", cfg.file, path, err)
+		}
+		cfg.global[s.flag] = vals
+		return nil
+	}
+
+	t, ok := table(v)
+	if !ok {
+		return fmt.Errorf("%s: %s: want a table", cfg.file, path)
+	}
+	for _, k := range sortedKeys(t) {
+		s, ok := retentionSettings[k]
+		if !ok {
+			return fmt.Errorf("%s: %s.%s: unknown setting", cfg.file, path, k)
+		}
+		vals, err := s.values(t[k])
+		if err != nil {
+			return fmt.Errorf("%s: %s.%s: %v", cfg.file, path, k, err)
+		}
+		cfg.retention[s.flag] = vals
+	}
+	return nil
+}
+
+// values turns v into flag values, checking it is of the kind s wants
+func (s setting) values(v interface{}) ([]string, error) {
+	var vals []string
+	switch s.kind {
+	case "list":
+		switch v := v.(type) {
+		case string:
+			vals = []string{v}
+		case []interface{}:
+			for _, e := range v {
+				str, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("want a list of strings, found %v", e)
+				}
+				vals = append(vals, str)
+			}
+		default:
+			return nil, fmt.Errorf("want a list of strings, found %v", v)
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("want a string, found %v", v)
+		}
+		vals = []string{str}
+	case "int":
+		var n int64
+		switch v := v.(type) {
+		case int64:
+			n = v
+		case int:
+			n = int64(v)
+		default:
+			return nil, fmt.Errorf("want a whole number, found %v", v)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("want a number of at least 0, found %d", n)
+		}
+		vals = []string{fmt.Sprint(n)}
+	case "bool":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("want true or false, found %v", v)
+		}
+		vals = []string{fmt.Sprint(b)}
+	}
+
+	if s.check != nil {
+		for _, val := range vals {
+			if err := s.check(val); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vals, nil
+}
+
+// table returns v as a table; YAML gives nested tables with keys of any
+// type
+func table(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range t {
+			m[fmt.Sprint(k)] = v
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// layouts for placing each content object in the consolidated tree
+const (
+	layoutCanonical = "canonical"
+	layoutFirstSeen = "first-seen"
+	layoutShortest  = "shortest"
+	layoutSource    = "source-order"
+	layoutDate      = "date"
+)
+
+func consolidateMain(c *cli.Context) error {
+	dest := c.String("dest")
+	if dest == "" {
+		if err := cli.ShowCommandHelp(c, "consolidate"); err != nil {
+			return err
+		}
+		return usageError(fmt.Errorf("no destination folder specified"))
+	}
+	layout := c.String("layout")
+	switch layout {
+	case layoutCanonical, layoutFirstSeen, layoutShortest, layoutSource, layoutDate:
+	default:
+		return usageError(fmt.Errorf("unknown layout %q", layout))
+	}
+	if err := checkTemplate(c.String("template")); err != nil {
+		return usageError(err)
+	}
+	sources := c.StringSlice("source")
+	prefer := c.StringSlice("prefer")
+	if len(prefer) == 0 {
+		prefer = sources
+	}
+	mapFile := c.String("map")
+	if mapFile == "" {
+		mapFile = filepath.Clean(dest) + "-map.csv"
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var sel selection
+	if ref := c.String("snapshot"); ref != "" {
+		snap, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		sel.Snapshot = &snap
+	}
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	opts := storage.DefaultOptions()
+	opts.Hash = repo.HashAlgorithm()
+	if enc, ok := repo.(storage.Encryptable); ok {
+		opts.Key = enc.Key()
+	}
+	m := merger{
+		Opts:     opts,
+		Layout:   layout,
+		Template: c.String("template"),
+		Dest:     dest,
+		Sources:  cleanRoots(sources),
+		Prefer:   cleanRoots(prefer),
+		rank:     firstSeen(snaps),
+	}
+	plan := m.plan(sel.find(repo))
+	if rel, err := filepath.Rel(dest, mapFile); err == nil && m.taken[filepath.ToSlash(rel)] {
+		return fmt.Errorf("map file %s would overwrite a consolidated file", mapFile)
+	}
+
+	dryRun, verbose := c.Bool("dry-run"), c.GlobalBool("verbose")
+	var rows [][]string
+	var written, present, failed int
+	var total uint64
+	for _, p := range plan {
+		if dryRun || verbose {
+			fmt.Printf("%s => %s\n", p.E.Name, p.Dest)
+		}
+		if p.Present {
+			present++
+		} else {
+			if !dryRun {
+				if err := restoreFile(filepath.Join(dest, filepath.FromSlash(p.Dest)), p.O, p.E); err != nil {
+					fmt.Fprintf(os.Stderr, "ERR: %s: %v\n", p.E.Name, err)
+					failed++
+					continue
+				}
+			}
+			written++
+			total += p.O.Size()
+		}
+		for _, name := range p.Names {
+			rows = append(rows, []string{name, p.Dest, p.O.Hash().String()})
+		}
+	}
+
+	verb := "wrote"
+	if dryRun {
+		verb = "would write"
+	}
+	fmt.Printf("%s %d object(s), %d bytes, for %d path(s) into %s; %d already there\n", verb, written, total, len(rows), dest, present)
+	if !dryRun {
+		if err = writeMapping(mapFile, rows); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d object(s) could not be written", failed)
+	}
+	return nil
+}
+
+// merger places every content object once in a destination tree
+type merger struct {
+	// Opts identify content already in the destination
+	Opts     storage.Options
+	Layout   string
+	Template string
+	Dest     string
+	Sources  []string
+	Prefer   []string
+
+	rank  map[string]int
+	taken map[string]bool
+}
+
+// placement is the one copy of an object in the consolidated tree
+type placement struct {
+	O     storage.Object
+	E     storage.Entry
+	Names []string
+	Dest  string
+	// Present is set when Dest already holds the content, as after an
+	// earlier run into the same destination
+	Present bool
+}
+
+// plan groups the selected names by content and picks a destination for
+// each group; names outside the sources are left out
+func (m *merger) plan(found []selected) []placement {
+	var order []storage.ID
+	groups := map[storage.ID]*placement{}
+	entries := map[storage.ID][]storage.Entry{}
+	for _, item := range found {
+		if len(m.Sources) > 0 && rootIndex(item.E.Name, m.Sources) == len(m.Sources) {
+			continue
+		}
+		id := item.O.Hash()
+		p, ok := groups[id]
+		if !ok {
+			p = &placement{O: item.O}
+			groups[id] = p
+			order = append(order, id)
+		}
+		p.Names = append(p.Names, item.E.Name)
+		entries[id] = append(entries[id], item.E)
+	}
+
+	plan := make([]placement, 0, len(order))
+	for _, id := range order {
+		p := groups[id]
+		p.E = m.choose(p.O, entries[id])
+		sort.Strings(p.Names)
+		plan = append(plan, *p)
+	}
+	sort.Slice(plan, func(i, j int) bool { return m.before(plan[i].E, plan[j].E) })
+
+	m.taken = map[string]bool{}
+	for i := range plan {
+		plan[i].Dest, plan[i].Present = m.claim(m.place(plan[i].E, entries[plan[i].O.Hash()]), plan[i].O)
+	}
+	return plan
+}
+
+// choose picks the name an object is copied from. The canonical and date
+// layouts take the chosen canonical name of o when it is among entries
+func (m *merger) choose(o storage.Object, entries []storage.Entry) storage.Entry {
+	if m.Layout == layoutCanonical || m.Layout == layoutDate {
+		for _, e := range entries {
+			if e.Name == o.Canonical() {
+				return e
+			}
+		}
+	}
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if m.before(e, best) {
+			best = e
+		}
+	}
+	return best
+}
+
+// before orders names by the layout, then by when they were first seen
+func (m *merger) before(a, b storage.Entry) bool {
+	switch m.Layout {
+	case layoutShortest:
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+	case layoutSource:
+		if ra, rb := rootIndex(a.Name, m.Prefer), rootIndex(b.Name, m.Prefer); ra != rb {
+			return ra < rb
+		}
+	}
+	if ra, rb := m.seen(a.Name), m.seen(b.Name); ra != rb {
+		return ra < rb
+	}
+	return a.Name < b.Name
+}
+
+func (m *merger) seen(name string) int {
+	if r, ok := m.rank[name]; ok {
+		return r
+	}
+	return len(m.rank)
+}
+
+// place returns the path of e relative to the destination
+func (m *merger) place(e storage.Entry, all []storage.Entry) string {
+	rel := relativeName(e, m.Sources)
+	if m.Layout == layoutDate {
+		oldest := e.ModTime
+		for _, other := range all {
+			if !other.ModTime.IsZero() && (oldest.IsZero() || other.ModTime.Before(oldest)) {
+				oldest = other.ModTime
+			}
+		}
+		year, month, day := "unknown", "unknown", "unknown"
+		if !oldest.IsZero() {
+			year, month, day = oldest.Format("2006"), oldest.Format("01"), oldest.Format("02")
+		}
+		ext := path.Ext(rel)
+		rel = strings.NewReplacer(
+			"{year}", year,
+			"{month}", month,
+			"{day}", day,
+			"{name}", path.Base(rel),
+			"{base}", strings.TrimSuffix(path.Base(rel), ext),
+			"{ext}", strings.TrimPrefix(ext, "."),
+			"{dir}", path.Dir(rel),
+		).Replace(m.Template)
+	}
+	return strings.TrimPrefix(path.Clean("/"+rel), "/")
+}
+
+// claim reserves rel in the destination for o, numbering it when another
+// object or an existing file already has that path. A file that already
+// holds the content of o is taken as it is, and reported as present
+func (m *merger) claim(rel string, o storage.Object) (string, bool) {
+	ext := path.Ext(rel)
+	base := strings.TrimSuffix(rel, ext)
+	for i := 0; ; i++ {
+		candidate := rel
+		if i > 0 {
+			candidate = base + "." + strconv.Itoa(i) + ext
+		}
+		if m.taken[candidate] {
+			continue
+		}
+		file := filepath.Join(m.Dest, filepath.FromSlash(candidate))
+		fi, err := os.Lstat(file)
+		if err != nil {
+			m.taken[candidate] = true
+			return candidate, false
+		}
+		if fi.Mode().IsRegular() && uint64(fi.Size()) == o.Size() {
+			if id, err := storage.HashFile(file, m.Opts); err == nil && id == o.Hash() {
+				m.taken[candidate] = true
+				return candidate, true
+			}
+		}
+	}
+}
+
+var templateField = regexp.MustCompile(`\{[^{}]*\}`)
+
+// checkTemplate reports placeholders a date template does not know
+func checkTemplate(t string) error {
+	for _, field := range templateField.FindAllString(t, -1) {
+		switch field {
+		case "{year}", "{month}", "{day}", "{name}", "{base}", "{ext}", "{dir}":
+		default:
+			return fmt.Errorf("unknown template field %s", field)
+		}
+	}
+	return nil
+}
+
+// firstSeen ranks every name by the oldest snapshot it appears in, and
+// within a snapshot by the order of its roots
+func firstSeen(snaps []storage.Snapshot) map[string]int {
+	snaps = append([]storage.Snapshot(nil), snaps...)
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+
+	rank := map[string]int{}
+	for _, snap := range snaps {
+		names := snap.Names()
+		roots := cleanRoots(snap.Roots)
+		sort.SliceStable(names, func(i, j int) bool {
+			return rootIndex(names[i], roots) < rootIndex(names[j], roots)
+		})
+		for _, name := range names {
+			if _, ok := rank[name]; !ok {
+				rank[name] = len(rank)
+			}
+		}
+	}
+	return rank
+}
+
+// cleanRoots puts folders in the form names are recorded in
+func cleanRoots(dirs []string) []string {
+	roots := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		roots = append(roots, path.Clean(filepath.ToSlash(dir)))
+	}
+	return roots
+}
+
+// rootIndex returns the position of the first root name is under, or
+// len(roots) if it is under none of them
+func rootIndex(name string, roots []string) int {
+	for i, root := range roots {
+		if root == "." || name == root || strings.HasPrefix(name, root+"/") {
+			return i
+		}
+	}
+	return len(roots)
+}
+
+// relativeName is the name of e without the root it was found under
+func relativeName(e storage.Entry, roots []string) string {
+	root := e.Root
+	if i := rootIndex(e.Name, roots); i < len(roots) {
+		root = roots[i]
+	}
+	if root == "" || root == "." || !strings.HasPrefix(e.Name, root) {
+		return e.Name
+	}
+	if rel := strings.TrimPrefix(e.Name[len(root):], "/"); rel != "" {
+		return rel
+	}
+	return path.Base(e.Name)
+}
+
+// writeMapping records where every original path ended up
+func writeMapping(file string, rows [][]string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	if err = cw.Write([]string{"original", "destination", "id"}); err == nil {
+		err = cw.WriteAll(rows)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
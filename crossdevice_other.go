@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package main
+
+// crossDevice reports whether err is a rename refused because source and
+// destination are on different filesystems, which is never known here
+func crossDevice(err error) bool { return false }
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE, returned when a file is
+// moved to another volume
+const errorNotSameDevice = syscall.Errno(17)
+
+// crossDevice reports whether err is a rename refused because source and
+// destination are on different volumes
+func crossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// dedupe modes: replace a duplicate with a reference to its canonical
+// copy, or move it out of the way into a quarantine folder
+const (
+	linkHard       = "hardlink"
+	linkReflink    = "reflink"
+	linkSymlink    = "symlink"
+	modeQuarantine = "quarantine"
+)
+
+func dedupeMain(c *cli.Context) error {
+	mode := c.String("mode")
+	switch mode {
+	case linkHard, linkReflink, linkSymlink, modeQuarantine:
+	default:
+		return usageError(fmt.Errorf("unknown dedupe mode %q", mode))
+	}
+	if c.Bool("cross-device") && mode != linkSymlink {
+		return usageError(fmt.Errorf("only symlinks can cross filesystems"))
+	}
+	minSize, err := storage.ParseSize(c.String("min-size"))
+	if err != nil {
+		return usageError(err)
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var snap *storage.Snapshot
+	if ref := c.String("snapshot"); ref != "" {
+		s, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		snap = &s
+	}
+
+	d := deduper{
+		Mode:        mode,
+		CrossDevice: c.Bool("cross-device"),
+		IgnoreMtime: c.Bool("ignore-mtime"),
+		DryRun:      c.Bool("dry-run"),
+		Verbose:     c.GlobalBool("verbose"),
+	}
+	if mode == modeQuarantine {
+		d.Journal = &journal{Dir: c.String("quarantine")}
+	}
+	groups, err := findDupes(repo, snap, minSize)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		d.group(g)
+	}
+
+	verb := "linked"
+	if d.DryRun {
+		verb = "would link"
+	}
+	if mode == modeQuarantine {
+		verb = "quarantined"
+		if d.DryRun {
+			verb = "would quarantine"
+		}
+	}
+	fmt.Printf("%s %d file(s), saving %d bytes; %d skipped\n", verb, d.linked, d.saved, d.skipped)
+	switch {
+	case d.metadata > 0 && d.IgnoreMtime:
+		fmt.Printf("%d of them differ from the copy kept in mode or owner\n", d.metadata)
+	case d.metadata > 0:
+		fmt.Printf("%d of them differ from the copy kept in mode, owner or mtime; --ignore-mtime links those that only differ in mtime\n", d.metadata)
+	}
+	if d.failed > 0 {
+		return fmt.Errorf("%d file(s) could not be deduplicated", d.failed)
+	}
+	return nil
+}
+
+// deduper replaces duplicate files with links to one canonical copy, or
+// moves them into quarantine when it has a Journal
+type deduper struct {
+	Mode        string
+	CrossDevice bool
+	IgnoreMtime bool
+	DryRun      bool
+	Verbose     bool
+	Journal     *journal
+
+	linked, skipped, failed int
+	metadata                int
+	saved                   uint64
+}
+
+// present is a name of a duplicate group as it is found on disk
+type present struct {
+	Name string
+	Info os.FileInfo
+}
+
+// group links every file of g to the canonical copy on the same device,
+// or to a single canonical copy when crossing devices is allowed. The
+// chosen canonical name of g is used where it is present, and the first
+// name otherwise
+func (d *deduper) group(g dupeGroup) {
+	byDevice := map[uint64][]present{}
+	var devices []uint64
+	for _, name := range g.Names {
+		fi, err := os.Lstat(name)
+		if err != nil || !fi.Mode().IsRegular() || uint64(fi.Size()) != g.Size {
+			d.skip(name, "missing or changed since it was added")
+			continue
+		}
+		dev := deviceOf(fi)
+		if d.CrossDevice || d.Journal != nil {
+			dev = 0
+		}
+		if _, ok := byDevice[dev]; !ok {
+			devices = append(devices, dev)
+		}
+		byDevice[dev] = append(byDevice[dev], present{Name: name, Info: fi})
+	}
+
+	for _, dev := range devices {
+		files := byDevice[dev]
+		for i, f := range files {
+			if f.Name == g.Canonical {
+				files[0], files[i] = files[i], files[0]
+			}
+		}
+		canonical := files[0]
+		for _, dup := range files[1:] {
+			d.link(canonical, dup, g)
+		}
+	}
+}
+
+func (d *deduper) link(canonical, dup present, g dupeGroup) {
+	if os.SameFile(canonical.Info, dup.Info) {
+		return
+	}
+	if (d.Mode == linkHard || d.Mode == linkSymlink) && !sameMetadata(canonical.Info, dup.Info, !d.IgnoreMtime) {
+		d.metadata++
+		d.skip(dup.Name, "mode, owner or mtime differs from "+canonical.Name)
+		return
+	}
+	same, err := sameContent(canonical.Name, dup.Name)
+	if err != nil {
+		d.fail(dup.Name, err)
+		return
+	}
+	if !same {
+		d.skip(dup.Name, "content differs from "+canonical.Name)
+		return
+	}
+
+	if d.Verbose || d.DryRun {
+		fmt.Printf("%s %s => %s\n", d.Mode, dup.Name, canonical.Name)
+	}
+	if !d.DryRun {
+		if d.Journal != nil {
+			err = d.Journal.quarantine(dup.Name, dup.Info, g, canonical.Name)
+		} else {
+			err = replaceWithLink(d.Mode, canonical.Name, dup.Name, dup.Info)
+		}
+		if err != nil {
+			d.fail(dup.Name, err)
+			return
+		}
+	}
+	d.linked++
+	d.saved += g.Size
+}
+
+func (d *deduper) skip(name, reason string) {
+	d.skipped++
+	if d.Verbose {
+		fmt.Printf("skip %s: %s\n", name, reason)
+	}
+}
+
+func (d *deduper) fail(name string, err error) {
+	d.failed++
+	fmt.Fprintf(os.Stderr, "ERR: %s: %v\n", name, err)
+}
+
+// replaceWithLink swaps dup for a link to canonical. The link is made
+// under a temporary name first and renamed over dup, so dup is never
+// missing. Reflinks are new files and get the metadata dup had; hard and
+// symbolic links share the metadata of canonical, so they are only made
+// when mode and owner already match, and mtime unless it is ignored
+func replaceWithLink(mode, canonical, dup string, fi os.FileInfo) error {
+	// reserve a unique name, then free it for the link to take; only what
+	// this call creates under it is ever removed
+	f, err := os.CreateTemp(filepath.Dir(dup), ".consolidate-link-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	if err = os.Remove(tmp); err != nil {
+		return err
+	}
+
+	created := false
+	switch mode {
+	case linkHard:
+		err = os.Link(canonical, tmp)
+		created = err == nil
+	case linkSymlink:
+		var target string
+		if target, err = filepath.Abs(canonical); err == nil {
+			err = os.Symlink(target, tmp)
+			created = err == nil
+		}
+	case linkReflink:
+		if err = reflink(canonical, tmp); err == nil {
+			created = true
+			err = storage.ApplyEntry(tmp, storage.NewEntry(dup, filepath.Dir(dup), fi))
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dup)
+	}
+	if err != nil && created {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// sameContent compares two files byte for byte
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if endA || endB {
+			return endA && endB, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// sameMetadata reports whether a link to a would show the mode and owner
+// b shows now, and its mtime when mtime is set
+func sameMetadata(a, b os.FileInfo, mtime bool) bool {
+	uidA, gidA := ownerOf(a)
+	uidB, gidB := ownerOf(b)
+	if mtime && !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	return a.Mode() == b.Mode() && uidA == uidB && gidA == gidB
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func dupesMain(c *cli.Context) error {
+	minSize, err := storage.ParseSize(c.String("min-size"))
+	if err != nil {
+		return usageError(err)
+	}
+	less, err := dupeOrder(c.String("sort"))
+	if err != nil {
+		return usageError(err)
+	}
+	write, ok := dupeWriters[c.String("format")]
+	if !ok {
+		return usageError(fmt.Errorf("unknown format %q", c.String("format")))
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var snap *storage.Snapshot
+	if ref := c.String("snapshot"); ref != "" {
+		s, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		snap = &s
+	}
+
+	groups, err := findDupes(repo, snap, minSize)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return less(groups[i], groups[j]) })
+	return write(os.Stdout, groups)
+}
+
+// dupeGroup is one content object stored under more than one path
+type dupeGroup struct {
+	ID        storage.ID     `json:"id"`
+	Size      uint64         `json:"size"`
+	Wasted    uint64         `json:"wasted"`
+	Names     []string       `json:"names"`
+	Canonical string         `json:"canonical,omitempty"`
+	Object    storage.Object `json:"-"`
+}
+
+// findDupes groups the names of r, or of snap when it is given, by
+// content and returns every group of at least minSize bytes with more
+// than one name
+func findDupes(r storage.Repository, snap *storage.Snapshot, minSize uint64) ([]dupeGroup, error) {
+	var objects []storage.Object
+	names := map[storage.ID][]string{}
+	if snap != nil {
+		for _, name := range snap.Names() {
+			names[snap.Files[name]] = append(names[snap.Files[name]], name)
+		}
+		for id, list := range names {
+			if len(list) < 2 {
+				continue
+			}
+			if obj := r.Object(id); obj != nil {
+				objects = append(objects, obj)
+			}
+		}
+	} else {
+		all, err := allObjects(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range all {
+			names[obj.Hash()] = obj.Names()
+			objects = append(objects, obj)
+		}
+	}
+
+	groups := []dupeGroup{}
+	for _, obj := range objects {
+		list := names[obj.Hash()]
+		if len(list) < 2 || obj.Size() < minSize {
+			continue
+		}
+		sort.Strings(list)
+		groups = append(groups, dupeGroup{
+			ID:        obj.Hash(),
+			Size:      obj.Size(),
+			Wasted:    obj.Size() * uint64(len(list)-1),
+			Names:     list,
+			Canonical: canonicalOf(obj, list),
+			Object:    obj,
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+func dupeOrder(key string) (func(a, b dupeGroup) bool, error) {
+	switch key {
+	case "wasted":
+		return func(a, b dupeGroup) bool { return a.Wasted > b.Wasted }, nil
+	case "size":
+		return func(a, b dupeGroup) bool { return a.Size > b.Size }, nil
+	case "count":
+		return func(a, b dupeGroup) bool { return len(a.Names) > len(b.Names) }, nil
+	case "name":
+		return func(a, b dupeGroup) bool { return a.Names[0] < b.Names[0] }, nil
+	}
+	return nil, fmt.Errorf("unknown sort key %q", key)
+}
+
+var dupeWriters = map[string]func(io.Writer, []dupeGroup) error{
+	"text": writeDupesText,
+	"json": writeDupesJSON,
+	"csv":  writeDupesCSV,
+}
+
+func writeDupesText(w io.Writer, groups []dupeGroup) error {
+	var wasted uint64
+	for _, g := range groups {
+		wasted += g.Wasted
+		if _, err := fmt.Fprintf(w, "%s  size %d  wasted %d  copies %d\n", g.ID, g.Size, g.Wasted, len(g.Names)); err != nil {
+			return err
+		}
+		for _, name := range g.Names {
+			mark := " "
+			if name == g.Canonical {
+				mark = "*"
+			}
+			if _, err := fmt.Fprintf(w, "  %s %s\n", mark, name); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d group(s), %d bytes wasted\n", len(groups), wasted)
+	return err
+}
+
+func writeDupesJSON(w io.Writer, groups []dupeGroup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(groups)
+}
+
+func writeDupesCSV(w io.Writer, groups []dupeGroup) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "size", "wasted", "copies", "name", "canonical"}); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		for _, name := range g.Names {
+			row := []string{
+				g.ID.String(),
+				strconv.FormatUint(g.Size, 10),
+				strconv.FormatUint(g.Wasted, 10),
+				strconv.Itoa(len(g.Names)),
+				name,
+				strconv.FormatBool(name == g.Canonical),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func deviceOf(fi os.FileInfo) uint64    { return 0 }
+func ownerOf(fi os.FileInfo) (int, int) { return -1, -1 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func findMain(c *cli.Context) error {
+	if !c.Args().Present() {
+		return usageError(fmt.Errorf("missing query, e.g. 'tag:photos AND size>1MB'"))
+	}
+	q, err := storage.ParseQuery(strings.Join(c.Args(), " "))
+	if err != nil {
+		return usageError(err)
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+
+	var found []nameMatch
+	if ref := c.String("snapshot"); ref != "" {
+		snap, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		objects := map[storage.ID]storage.Object{}
+		for _, name := range snap.Names() {
+			id := snap.Files[name]
+			obj, ok := objects[id]
+			if !ok {
+				if obj = repo.Object(id); obj == nil {
+					continue
+				}
+				objects[id] = obj
+			}
+			if q.Match(obj, name) {
+				found = append(found, nameMatch{name, obj})
+			}
+		}
+	} else {
+		objects, err := repo.Find(q)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			for _, name := range obj.Names() {
+				if q.Match(obj, name) {
+					found = append(found, nameMatch{name, obj})
+				}
+			}
+		}
+	}
+	printNames(found, c.Bool("long"))
+	return nil
+}
+
+// nameMatch is a name together with the object stored under it
+type nameMatch struct {
+	name string
+	obj  storage.Object
+}
+
+// printNames lists found by name, with the id and size of each when long
+func printNames(found []nameMatch, long bool) {
+	sort.Slice(found, func(i, j int) bool { return found[i].name < found[j].name })
+	for _, m := range found {
+		if long {
+			fmt.Printf("%s  %12d  %s\n", m.obj.Hash(), m.obj.Size(), m.name)
+			continue
+		}
+		fmt.Println(m.name)
+	}
+}
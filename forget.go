@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func forgetMain(c *cli.Context) error {
+	within, err := parseAge(c.String("keep-within"))
+	if err != nil {
+		return usageError(err)
+	}
+	policy := storage.Policy{
+		Last:    c.Int("keep-last"),
+		Daily:   c.Int("keep-daily"),
+		Weekly:  c.Int("keep-weekly"),
+		Monthly: c.Int("keep-monthly"),
+		Yearly:  c.Int("keep-yearly"),
+		Within:  within,
+		Tags:    c.StringSlice("keep-tag"),
+	}
+	if policy.Empty() {
+		return usageError(fmt.Errorf("no retention policy given; refusing to forget every snapshot"))
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	dryRun := c.Bool("dry-run")
+	keep, forget, reasons := policy.Apply(snaps)
+	if c.GlobalBool("verbose") {
+		for _, s := range keep {
+			fmt.Printf("keep    %s  %s  (%s)\n", s.ID, s.Time.Format(time.RFC3339), strings.Join(reasons[s.ID], ", "))
+		}
+	}
+	for _, s := range forget {
+		fmt.Printf("forget  %s  %s\n", s.ID, s.Time.Format(time.RFC3339))
+		if dryRun {
+			continue
+		}
+		if err = repo.ForgetSnapshot(s.ID); err != nil {
+			return err
+		}
+	}
+
+	if !c.Bool("prune") {
+		return nil
+	}
+	return prune(repo, keep, dryRun)
+}
+
+func pruneMain(c *cli.Context) error {
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+	return prune(repo, snaps, c.Bool("dry-run"))
+}
+
+// prune removes every object none of keep refers to
+func prune(r storage.Repository, keep []storage.Snapshot, dryRun bool) error {
+	plan, err := planPrune(r, keep)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range plan.Remove {
+		names := obj.Names()
+		fmt.Printf("remove  %s  %d  %s\n", obj.Hash(), obj.Size(), strings.Join(names, " "))
+		if dryRun {
+			continue
+		}
+		if err = r.Remove(obj.Hash()); err != nil {
+			return err
+		}
+	}
+
+	verb := "freed"
+	if dryRun {
+		verb = "would free"
+	}
+	fmt.Printf("%d object(s), %s %d bytes\n", len(plan.Remove), verb, plan.Freed)
+	return nil
+}
+
+// prunePlan is the set of objects no kept snapshot refers to, and the
+// stored bytes that removing them frees
+type prunePlan struct {
+	Remove []storage.Object
+	Freed  uint64
+}
+
+func planPrune(r storage.Repository, keep []storage.Snapshot) (prunePlan, error) {
+	var plan prunePlan
+
+	live := map[storage.ID]bool{}
+	for _, s := range keep {
+		full, err := r.Snapshot(s.ID)
+		if err != nil {
+			return plan, err
+		}
+		for _, id := range full.Files {
+			live[id] = true
+		}
+	}
+
+	objects, err := allObjects(r)
+	if err != nil {
+		return plan, err
+	}
+	liveChunks := map[storage.ID]bool{}
+	var dead []storage.Object
+	for _, obj := range objects {
+		if !live[obj.Hash()] {
+			dead = append(dead, obj)
+			continue
+		}
+		for _, c := range obj.Chunks() {
+			liveChunks[c.ID] = true
+		}
+	}
+
+	freed := map[storage.ID]bool{}
+	for _, obj := range dead {
+		for _, c := range obj.Chunks() {
+			if !liveChunks[c.ID] && !freed[c.ID] {
+				freed[c.ID] = true
+				plan.Freed += c.CompressedSize
+			}
+		}
+	}
+	plan.Remove = dead
+	return plan, nil
+}
+
+// allObjects returns every object in r once
+func allObjects(r storage.Repository) ([]storage.Object, error) {
+	objects := []storage.Object{}
+	err := r.Iterate(func(obj storage.Object) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	return objects, err
+}
+
+// parseAge reads a duration that may also be given in days, weeks, months
+// or years, such as "36h", "30d", "2w", "6m" or "1y"
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := map[byte]time.Duration{
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'm': 30 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if unit, ok := units[s[len(s)-1]]; ok {
+		if n, err := strconv.Atoi(s[:len(s)-1]); err == nil {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func lsMain(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return usageError(fmt.Errorf("want at most one prefix, found %d arguments", c.NArg()))
+	}
+	prefix := c.Args().First()
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+
+	var found []nameMatch
+	if ref := c.String("snapshot"); ref != "" {
+		snap, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		objects := map[storage.ID]storage.Object{}
+		for _, name := range snap.Names() {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			id := snap.Files[name]
+			obj, ok := objects[id]
+			if !ok {
+				if obj = repo.Object(id); obj == nil {
+					continue
+				}
+				objects[id] = obj
+			}
+			found = append(found, nameMatch{name, obj})
+		}
+	} else {
+		err = repo.Iterate(func(obj storage.Object) error {
+			for _, name := range obj.Names() {
+				if strings.HasPrefix(name, prefix) {
+					found = append(found, nameMatch{name, obj})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	printNames(found, c.Bool("long"))
+	return nil
+}
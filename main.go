@@ -7,25 +7,462 @@ import (
 	"github.com/urfave/cli"
 )
 
+// exit codes
+const (
+	exitFailure = 1 // the command failed
+	exitUsage   = 2 // bad flags, arguments or config file
+	exitDamaged = 3 // verify found damaged or missing objects
+)
+
+// usageError marks err as a mistake in how consolidate was run
+func usageError(err error) error {
+	return cli.NewExitError(err.Error(), exitUsage)
+}
+
+func onUsageError(c *cli.Context, err error, _ bool) error {
+	return usageError(fmt.Errorf("%v (see --help)", err))
+}
+
+// rootMain runs when no command is given
+func rootMain(c *cli.Context) error {
+	if c.Args().Present() {
+		return usageError(fmt.Errorf("unknown command %q (see --help)", c.Args().First()))
+	}
+	return cli.ShowAppHelp(c)
+}
+
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitFailure)
+	}
+}
+
+// newApp builds the command line of consolidate
+func newApp() *cli.App {
 	app := cli.NewApp()
-	app.Action = appMain
+	app.Usage = "back up folders into a deduplicating repository and sort out the copies"
+	app.Action = rootMain
+	app.OnUsageError = onUsageError
 	app.Flags = []cli.Flag{
-		cli.StringSliceFlag{
-			Name:  "source, s",
-			Usage: "source folder(s) to backup",
+		cli.StringFlag{
+			Name:   "config, c",
+			Usage:  "config file (default consolidate.toml or .yaml here, in the user config folder or in /etc/consolidate)",
+			EnvVar: "CONSOLIDATE_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "profile, P",
+			Usage:  "profile of the config file to use",
+			EnvVar: "CONSOLIDATE_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "repo, r",
+			Value:  "sqlite:.consolidate.db",
+			Usage:  "repository to use: sqlite:///path/to.db, dir:///path/to/dir or memory:",
+			EnvVar: "CONSOLIDATE_REPO",
+		},
+		cli.StringFlag{
+			Name:  "hash",
+			Usage: "content id hash of a new repository: sha256 or sha512/256 (default sha256)",
 		},
-		cli.StringSliceFlag{
-			Name:  "exclude, x",
-			Usage: "folder(s) to exclude", //TODO:better
+		cli.BoolFlag{
+			Name:  "encrypt",
+			Usage: "encrypt a new repository",
+		},
+		cli.BoolFlag{
+			Name:  "encrypt-names",
+			Usage: "with --encrypt, also encrypt names and tags",
+		},
+		cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "file holding the repository passphrase (default $CONSOLIDATE_PASSPHRASE)",
 		},
 		cli.BoolFlag{
 			Name:  "verbose, V",
 			Usage: "verbose output",
 		},
 	}
-	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+	app.Commands = []cli.Command{
+		{
+			Name:   "add",
+			Usage:  "back up source folders and record the run as a snapshot",
+			Action: addMain,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "source, s",
+					Usage: "source folder(s) to backup",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude, x",
+					Usage: "folder(s) to exclude", //TODO:better
+				},
+				cli.StringSliceFlag{
+					Name:  "snapshot-tag",
+					Usage: "tag(s) for the snapshot of this run",
+				},
+				cli.StringFlag{
+					Name:  "compression, z",
+					Value: "zlib",
+					Usage: "codec for new data: none, zlib, gzip, zstd or lz4",
+				},
+				cli.BoolFlag{
+					Name:  "rehash",
+					Usage: "read every file again, even those whose size, times and inode are unchanged since the last run",
+				},
+			},
+		},
+		{
+			Name:      "ls",
+			Usage:     "list stored names, or those starting with a prefix",
+			ArgsUsage: "[prefix]",
+			Action:    lsMain,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "long, l",
+					Usage: "also show the id and size of each name",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "list names as they were in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:      "find",
+			Usage:     "list names matching a query of tag:, name: and size terms joined by AND, OR and NOT",
+			ArgsUsage: "query",
+			Action:    findMain,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "long, l",
+					Usage: "also show the id and size of each match",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "restore",
+			Usage:  "write files from the repository back out",
+			Action: restoreMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target, t",
+					Usage: "folder to restore into",
+				},
+				cli.StringFlag{
+					Name:  "prefix, p",
+					Usage: "only restore names starting with this prefix",
+				},
+				cli.StringFlag{
+					Name:  "glob, g",
+					Usage: "only restore names matching this pattern",
+				},
+				cli.StringFlag{
+					Name:  "tag",
+					Usage: "only restore objects with this tag",
+				},
+				cli.StringFlag{
+					Name:  "conflict",
+					Value: "skip",
+					Usage: "what to do with existing files: skip, overwrite or rename",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "restore files as they were in this snapshot (id prefix or \"latest\")",
+				},
+				cli.BoolFlag{
+					Name:  "canonical",
+					Usage: "only restore the canonical name of each object",
+				},
+			},
+		},
+		{
+			Name:   "stats",
+			Usage:  "show what the repository holds",
+			Action: statsMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "text",
+					Usage: "output as text or json",
+				},
+			},
+		},
+		{
+			Name:        "verify",
+			Usage:       "read every object back and check it against its id",
+			Description: "Exits with 3 when an object is damaged or a snapshot refers to one that is missing.",
+			Action:      verifyMain,
+		},
+		{
+			Name:      "snapshots",
+			Usage:     "list snapshots, or the files of one snapshot",
+			ArgsUsage: "[snapshot]",
+			Action:    snapshotsMain,
+		},
+		{
+			Name:   "forget",
+			Usage:  "forget snapshots a retention policy does not keep",
+			Action: forgetMain,
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "keep-last", Usage: "keep the n newest snapshots"},
+				cli.IntFlag{Name: "keep-daily", Usage: "keep the newest snapshot of each of the last n days"},
+				cli.IntFlag{Name: "keep-weekly", Usage: "keep the newest snapshot of each of the last n weeks"},
+				cli.IntFlag{Name: "keep-monthly", Usage: "keep the newest snapshot of each of the last n months"},
+				cli.IntFlag{Name: "keep-yearly", Usage: "keep the newest snapshot of each of the last n years"},
+				cli.StringFlag{Name: "keep-within", Usage: "keep snapshots this close to the newest one, e.g. 30d"},
+				cli.StringSliceFlag{Name: "keep-tag", Usage: "keep snapshots with this tag"},
+				cli.BoolFlag{Name: "prune", Usage: "also remove objects no kept snapshot refers to"},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "only list what would be forgotten and removed"},
+			},
+		},
+		{
+			Name:   "dupes",
+			Usage:  "report content stored under more than one path",
+			Action: dupesMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "sort",
+					Value: "wasted",
+					Usage: "order groups by wasted, size, count or name",
+				},
+				cli.StringFlag{
+					Name:  "min-size",
+					Usage: "ignore content smaller than this, e.g. 1MB",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "text",
+					Usage: "output as text, json or csv",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "near",
+			Usage:  "report images that look alike, such as resized or re-encoded copies",
+			Action: nearMain,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "distance, d",
+					Value: 10,
+					Usage: "most bits of the 64 bit image hash that may differ",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "text",
+					Usage: "output as text or json",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "similar",
+			Usage:  "report text files that are mostly the same",
+			Action: similarMain,
+			Flags: []cli.Flag{
+				cli.Float64Flag{
+					Name:  "similarity",
+					Value: 0.95,
+					Usage: "fraction of their three word sequences two documents must share, from 0 to 1",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "text",
+					Usage: "output as text or json",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "semantic",
+			Usage:  "report media files that differ only in their tags or metadata",
+			Action: semanticMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "text",
+					Usage: "output as text or json",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "dedupe",
+			Usage:  "replace duplicate files with links to one copy",
+			Action: dedupeMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "mode",
+					Value: "hardlink",
+					Usage: "link with hardlink, reflink or symlink, or move copies to quarantine",
+				},
+				cli.StringFlag{
+					Name:  "quarantine, q",
+					Value: "consolidate-quarantine",
+					Usage: "folder the quarantine mode moves copies into",
+				},
+				cli.BoolFlag{
+					Name:  "cross-device",
+					Usage: "allow symlinks to a copy on another filesystem",
+				},
+				cli.BoolFlag{
+					Name:  "ignore-mtime",
+					Usage: "link copies whose mtime differs from the copy kept, which they then share",
+				},
+				cli.StringFlag{
+					Name:  "min-size",
+					Usage: "ignore content smaller than this, e.g. 1MB",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "only list what would be linked",
+				},
+			},
+		},
+		{
+			Name:   "canonical",
+			Usage:  "choose the canonical name of each duplicate group",
+			Action: canonicalMain,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "rule, r",
+					Usage: "rule in order of precedence: root:DIR, oldest, shortest, no-copy, match:REGEX or avoid:REGEX (default no-copy, oldest, shortest)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "only list the names that would be chosen",
+				},
+			},
+		},
+		{
+			Name:   "consolidate",
+			Usage:  "copy every distinct file once into a single folder",
+			Action: consolidateMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dest, d",
+					Usage: "folder to write the consolidated tree into",
+				},
+				cli.StringSliceFlag{
+					Name:  "source, s",
+					Usage: "only merge files from these source folders (default the sources of the config file)",
+				},
+				cli.StringFlag{
+					Name:  "layout",
+					Value: "canonical",
+					Usage: "keep the canonical, first-seen, shortest or source-order path, or lay out by date",
+				},
+				cli.StringSliceFlag{
+					Name:  "prefer",
+					Usage: "source folders in order of preference for the source-order layout",
+				},
+				cli.StringFlag{
+					Name:  "template",
+					Value: "{year}/{month}/{name}",
+					Usage: "path for the date layout, from {year} {month} {day} {name} {base} {ext} {dir}",
+				},
+				cli.StringFlag{
+					Name:  "map",
+					Usage: "file to record where each original path went (default DEST-map.csv, beside DEST)",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "merge files as they were in this snapshot (id prefix or \"latest\")",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "only list where each file would go",
+				},
+			},
+		},
+		{
+			Name:   "script",
+			Usage:  "write the dedupe plan as a shell script to review and run",
+			Action: scriptMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "mode",
+					Value: "hardlink",
+					Usage: "replace copies with a hardlink or symlink, remove them, or move them to quarantine",
+				},
+				cli.StringFlag{
+					Name:  "quarantine, q",
+					Value: "consolidate-quarantine",
+					Usage: "folder the quarantine mode moves copies into",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "file to write the script to (default stdout)",
+				},
+				cli.StringFlag{
+					Name:  "min-size",
+					Usage: "ignore content smaller than this, e.g. 1MB",
+				},
+				cli.StringFlag{
+					Name:  "snapshot",
+					Usage: "only consider paths in this snapshot (id prefix or \"latest\")",
+				},
+			},
+		},
+		{
+			Name:   "undo",
+			Usage:  "move quarantined files back where they were",
+			Action: undoMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "quarantine, q",
+					Value: "consolidate-quarantine",
+					Usage: "quarantine folder to restore from",
+				},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "only list what would be moved back"},
+			},
+		},
+		{
+			Name:   "purge",
+			Usage:  "delete quarantined files for good",
+			Action: purgeMain,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "quarantine, q",
+					Value: "consolidate-quarantine",
+					Usage: "quarantine folder to empty",
+				},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "only list what would be deleted"},
+			},
+		},
+		{
+			Name:   "prune",
+			Usage:  "remove objects no snapshot refers to",
+			Action: pruneMain,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run, n", Usage: "only list what would be removed"},
+			},
+		},
+	}
+	for i := range app.Commands {
+		cmd := &app.Commands[i]
+		cmd.Action = withConfig(cmd.Action.(func(*cli.Context) error))
+		cmd.OnUsageError = onUsageError
 	}
+	return app
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// exitCode runs consolidate with args and returns the code it exits with
+func exitCode(t *testing.T, args ...string) int {
+	t.Helper()
+	code := -1
+	exiter, errWriter := cli.OsExiter, cli.ErrWriter
+	cli.OsExiter = func(c int) {
+		if code < 0 {
+			code = c
+		}
+	}
+	cli.ErrWriter = io.Discard
+	defer func() { cli.OsExiter, cli.ErrWriter = exiter, errWriter }()
+
+	app := newApp()
+	app.Writer = io.Discard
+	err := app.Run(append([]string{"consolidate", "--repo", "memory:"}, args...))
+	switch {
+	case code >= 0:
+		return code
+	case err != nil:
+		return exitFailure
+	}
+	return 0
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	// bad holds, for every command, a run with a bad flag or argument
+	bad := map[string][]string{
+		"add":         {"add", "--source", dir, "--compression", "bogus"},
+		"ls":          {"ls", "a", "b"},
+		"find":        {"find", "size>"},
+		"restore":     {"restore", "--target", dir, "--conflict", "bogus"},
+		"stats":       {"stats", "--format", "bogus"},
+		"verify":      {"verify", "--bogus"},
+		"snapshots":   {"snapshots", "--bogus"},
+		"forget":      {"forget"},
+		"dupes":       {"dupes", "--format", "bogus"},
+		"near":        {"near", "--format", "bogus"},
+		"similar":     {"similar", "--similarity", "2"},
+		"semantic":    {"semantic", "--format", "bogus"},
+		"dedupe":      {"dedupe", "--mode", "bogus"},
+		"canonical":   {"canonical", "--rule", "bogus"},
+		"consolidate": {"consolidate", "--dest", dir, "--layout", "bogus"},
+		"script":      {"script", "--mode", "bogus"},
+		"undo":        {"undo", "--bogus"},
+		"purge":       {"purge", "--bogus"},
+		"prune":       {"prune", "--bogus"},
+	}
+	for _, cmd := range newApp().Commands {
+		args, ok := bad[cmd.Name]
+		if !ok {
+			t.Errorf("%s: no bad run to check", cmd.Name)
+			continue
+		}
+		if code := exitCode(t, args...); code != exitUsage {
+			t.Errorf("%v: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"stats"}, 0},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"--hash", "bogus", "stats"}, exitUsage},
+		{[]string{"dupes", "--sort", "bogus"}, exitUsage},
+		{[]string{"near", "--distance", "65"}, exitUsage},
+		{[]string{"add", "--source", dir + "/missing"}, exitFailure},
+	} {
+		if code := exitCode(t, c.args...); code != c.want {
+			t.Errorf("%v: exit %d, want %d", c.args, code, c.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func nearMain(c *cli.Context) error {
+	distance := c.Int("distance")
+	if distance < 0 || distance > 64 {
+		return usageError(fmt.Errorf("distance must be between 0 and 64 bits"))
+	}
+	return reportNear(c, storage.DHash, distance, "image(s)")
+}
+
+func similarMain(c *cli.Context) error {
+	similarity := c.Float64("similarity")
+	if similarity < 0 || similarity > 1 {
+		return usageError(fmt.Errorf("similarity must be between 0 and 1"))
+	}
+	return reportNear(c, storage.SimHash, simHashDistance(similarity), "document(s)")
+}
+
+// simHashDistance is how many bits the similarity hashes of two texts are
+// expected to differ in when the given fraction of their three word
+// shingles is shared, counted over the shingles of both (the Jaccard
+// index j). For texts of about the same length that is a cosine similarity
+// of 2j/(1+j), and each bit differs with a probability of the angle
+// between them over pi
+func simHashDistance(similarity float64) int {
+	cosine := 2 * similarity / (1 + similarity)
+	return int(math.Ceil(64 * math.Acos(cosine) / math.Pi))
+}
+
+// reportNear reports groups of objects whose kind fingerprints are at
+// most distance bits apart
+func reportNear(c *cli.Context, kind storage.Fingerprint, distance int, noun string) error {
+	write, ok := nearWriters[c.String("format")]
+	if !ok {
+		return usageError(fmt.Errorf("unknown format %q", c.String("format")))
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var snap *storage.Snapshot
+	if ref := c.String("snapshot"); ref != "" {
+		s, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		snap = &s
+	}
+
+	objects, names, err := namedObjects(repo, snap)
+	if err != nil {
+		return err
+	}
+	groups := nearGroups(objects, names, kind, distance)
+	return write(os.Stdout, groups, noun)
+}
+
+// namedObjects returns the objects of r with their names, or only those
+// named in snap when it is given
+func namedObjects(r storage.Repository, snap *storage.Snapshot) ([]storage.Object, map[storage.ID][]string, error) {
+	names := map[storage.ID][]string{}
+	if snap == nil {
+		objects, err := allObjects(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, obj := range objects {
+			names[obj.Hash()] = obj.Names()
+		}
+		return objects, names, nil
+	}
+
+	var objects []storage.Object
+	for _, name := range snap.Names() {
+		id := snap.Files[name]
+		if _, ok := names[id]; !ok {
+			obj := r.Object(id)
+			if obj == nil {
+				continue
+			}
+			objects = append(objects, obj)
+		}
+		names[id] = append(names[id], name)
+	}
+	return objects, names, nil
+}
+
+// nearMember is one object of a nearGroup; Distance is how many bits its
+// fingerprint differs from that of the first member
+type nearMember struct {
+	ID          storage.ID `json:"id"`
+	Fingerprint string     `json:"fingerprint"`
+	Distance    int        `json:"distance"`
+	Size        uint64     `json:"size"`
+	Names       []string   `json:"names"`
+}
+
+// nearGroup is a set of distinct objects linked by fingerprints that are
+// each at most a threshold apart
+type nearGroup struct {
+	Members []nearMember `json:"members"`
+}
+
+// nearGroups links every pair of objects whose kind fingerprints are at
+// most max bits apart and returns the groups with more than one member,
+// largest first
+func nearGroups(objects []storage.Object, names map[storage.ID][]string, kind storage.Fingerprint, max int) []nearGroup {
+	var members []nearMember
+	sums := map[storage.ID]uint64{}
+	for _, obj := range objects {
+		fp, ok := obj.Fingerprints()[kind]
+		if !ok {
+			continue
+		}
+		sum, err := storage.FingerprintBits(fp)
+		if err != nil {
+			continue
+		}
+		list := append([]string{}, names[obj.Hash()]...)
+		sort.Strings(list)
+		members = append(members, nearMember{ID: obj.Hash(), Fingerprint: fp, Size: obj.Size(), Names: list})
+		sums[obj.Hash()] = sum
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	fps := make([]uint64, len(members))
+	for i, m := range members {
+		fps[i] = sums[m.ID]
+	}
+
+	parent := make([]int, len(members))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	link := func(i, j int) {
+		if a, b := find(i), find(j); a != b && bits.OnesCount64(fps[i]^fps[j]) <= max {
+			parent[b] = a
+		}
+	}
+	if max >= 64 {
+		for i := 1; i < len(members); i++ {
+			link(0, i)
+		}
+	}
+	for _, bucket := range nearCandidates(fps, max) {
+		for x, i := range bucket {
+			for _, j := range bucket[x+1:] {
+				link(i, j)
+			}
+		}
+	}
+
+	byRoot := map[int][]nearMember{}
+	var roots []int
+	for i, m := range members {
+		root := find(i)
+		if _, ok := byRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], m)
+	}
+
+	groups := []nearGroup{}
+	for _, root := range roots {
+		list := byRoot[root]
+		if len(list) < 2 {
+			continue
+		}
+		for i := range list {
+			list[i].Distance = bits.OnesCount64(sums[list[0].ID] ^ sums[list[i].ID])
+		}
+		groups = append(groups, nearGroup{Members: list})
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i].Members) > len(groups[j].Members) })
+	return groups
+}
+
+// nearCandidates buckets the indexes of fps so that any two fingerprints at
+// most max bits apart share a bucket. The bits are cut into max+1 bands and
+// two such fingerprints must agree on at least one of them, so only pairs
+// within a bucket need comparing
+func nearCandidates(fps []uint64, max int) [][]int {
+	bands := max + 1
+	if bands > 64 {
+		return nil
+	}
+	type band struct {
+		n    int
+		bits uint64
+	}
+	buckets := map[band][]int{}
+	var order []band
+	for n := 0; n < bands; n++ {
+		lo, hi := uint(n*64/bands), uint((n+1)*64/bands)
+		mask := (^uint64(0) >> (64 - (hi - lo))) << lo
+		for i, fp := range fps {
+			k := band{n, fp & mask}
+			if _, ok := buckets[k]; !ok {
+				order = append(order, k)
+			}
+			buckets[k] = append(buckets[k], i)
+		}
+	}
+	var out [][]int
+	for _, k := range order {
+		if len(buckets[k]) > 1 {
+			out = append(out, buckets[k])
+		}
+	}
+	return out
+}
+
+var nearWriters = map[string]func(io.Writer, []nearGroup, string) error{
+	"text": writeNearText,
+	"json": writeNearJSON,
+}
+
+func writeNearText(w io.Writer, groups []nearGroup, noun string) error {
+	for i, g := range groups {
+		if _, err := fmt.Fprintf(w, "group %d: %d %s\n", i+1, len(g.Members), noun); err != nil {
+			return err
+		}
+		for _, m := range g.Members {
+			if _, err := fmt.Fprintf(w, "  %2d  %s  %s  size %d\n", m.Distance, m.Fingerprint, m.ID, m.Size); err != nil {
+				return err
+			}
+			for _, name := range m.Names {
+				if _, err := fmt.Fprintf(w, "        %s\n", name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d group(s)\n", len(groups))
+	return err
+}
+
+func writeNearJSON(w io.Writer, groups []nearGroup, _ string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(groups)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// a quarantine folder holds the moved files under files/, keeping their
+// original paths, and the journal of moves next to it
+const (
+	quarantineFiles   = "files"
+	quarantineJournal = "journal.jsonl"
+)
+
+func undoMain(c *cli.Context) error {
+	j := journal{Dir: c.String("quarantine")}
+	moves, err := j.read()
+	if err != nil {
+		return err
+	}
+	if len(moves) == 0 {
+		fmt.Println("nothing to undo")
+		return nil
+	}
+
+	dryRun, verbose := c.Bool("dry-run"), c.GlobalBool("verbose")
+	var kept []journalEntry
+	var restored, failed int
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := moves[i]
+		if _, err := os.Lstat(m.Quarantine); os.IsNotExist(err) {
+			if _, err := os.Lstat(m.Original); err == nil {
+				// journalled but never moved, so there is nothing to undo
+				continue
+			}
+		}
+		if _, err := os.Lstat(m.Original); err == nil {
+			fmt.Fprintf(os.Stderr, "ERR: %s: already exists, leaving it in quarantine\n", m.Original)
+			kept = append(kept, m)
+			failed++
+			continue
+		}
+		if dryRun || verbose {
+			fmt.Printf("restore %s => %s\n", m.Quarantine, m.Original)
+		}
+		if !dryRun {
+			if err := unquarantine(m); err != nil {
+				fmt.Fprintf(os.Stderr, "ERR: %s: %v\n", m.Original, err)
+				kept = append(kept, m)
+				failed++
+				continue
+			}
+		}
+		restored++
+	}
+
+	verb := "restored"
+	if dryRun {
+		verb = "would restore"
+	} else {
+		for i, k := 0, len(kept)-1; i < k; i, k = i+1, k-1 {
+			kept[i], kept[k] = kept[k], kept[i]
+		}
+		if err = j.write(kept); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s %d file(s) from %s\n", verb, restored, j.Dir)
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be restored", failed)
+	}
+	return nil
+}
+
+func purgeMain(c *cli.Context) error {
+	j := journal{Dir: c.String("quarantine")}
+	moves, err := j.read()
+	if err != nil {
+		return err
+	}
+
+	var freed uint64
+	var purged int
+	for _, m := range moves {
+		if _, err := os.Lstat(m.Quarantine); os.IsNotExist(err) {
+			continue
+		}
+		purged++
+		if c.Bool("dry-run") || c.GlobalBool("verbose") {
+			fmt.Printf("purge %s\n", m.Quarantine)
+		}
+		freed += m.Size
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("would purge %d file(s), freeing %d bytes\n", purged, freed)
+		return nil
+	}
+	if err = os.RemoveAll(filepath.Join(j.Dir, quarantineFiles)); err != nil {
+		return err
+	}
+	if err = os.Remove(j.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Printf("purged %d file(s), freeing %d bytes\n", purged, freed)
+	return nil
+}
+
+// journalEntry records one file moved into quarantine, with the metadata
+// it had so that it can be put back as it was
+type journalEntry struct {
+	Time       time.Time     `json:"time"`
+	Original   string        `json:"original"`
+	Quarantine string        `json:"quarantine"`
+	ID         storage.ID    `json:"id"`
+	Size       uint64        `json:"size"`
+	Canonical  string        `json:"canonical"`
+	Entry      storage.Entry `json:"entry"`
+}
+
+// journal is the log of moves into a quarantine folder, oldest first
+type journal struct {
+	Dir string
+}
+
+func (j journal) path() string { return filepath.Join(j.Dir, quarantineJournal) }
+
+func (j journal) read() ([]journalEntry, error) {
+	f, err := os.Open(j.path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var moves []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var m journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", j.path(), line, err)
+		}
+		moves = append(moves, m)
+	}
+	return moves, scanner.Err()
+}
+
+func (j journal) append(m journalEntry) error {
+	if err := os.MkdirAll(j.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(m)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write replaces the journal with moves, or removes it when there are none
+func (j journal) write(moves []journalEntry) error {
+	if len(moves) == 0 {
+		if err := os.Remove(j.path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(j.Dir, ".journal-")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	for _, m := range moves {
+		if err = enc.Encode(m); err != nil {
+			break
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path())
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// quarantine journals the move of name, a copy of canonical, then moves
+// it under the quarantine folder at the path it was recorded under. The
+// entry is written first so that a move is never left unrecorded, and is
+// taken back out if the move fails
+func (j journal) quarantine(name string, fi os.FileInfo, g dupeGroup, canonical string) error {
+	m, err := j.entry(name, fi, g, canonical)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(m.Quarantine), 0755); err != nil {
+		return err
+	}
+	if err = j.append(m); err != nil {
+		return err
+	}
+	if err = moveFile(m.Original, m.Quarantine, m.Entry); err != nil {
+		if derr := j.drop(m); derr != nil {
+			return fmt.Errorf("%v; and removing its journal entry: %v", err, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// entry is the journal entry for moving name, a copy of canonical, under
+// the quarantine folder at the path it was recorded under, renamed if a
+// file is already there
+func (j journal) entry(name string, fi os.FileInfo, g dupeGroup, canonical string) (journalEntry, error) {
+	original, err := filepath.Abs(name)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	dir, err := filepath.Abs(j.Dir)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	vol := filepath.VolumeName(name)
+	rel := path.Clean("/" + filepath.ToSlash(name[len(vol):]))
+	dest := filepath.Join(dir, quarantineFiles, strings.TrimSuffix(vol, ":"), filepath.FromSlash(rel))
+	dest, _ = resolveConflict(dest, conflictRename)
+
+	return journalEntry{
+		Time:       time.Now(),
+		Original:   original,
+		Quarantine: dest,
+		ID:         g.ID,
+		Size:       g.Size,
+		Canonical:  canonical,
+		Entry:      storage.NewEntry(original, filepath.Dir(original), fi),
+	}, nil
+}
+
+// drop removes the latest entry for the quarantine path of m
+func (j journal) drop(m journalEntry) error {
+	moves, err := j.read()
+	if err != nil {
+		return err
+	}
+	for i := len(moves) - 1; i >= 0; i-- {
+		if moves[i].Quarantine == m.Quarantine {
+			return j.write(append(moves[:i], moves[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// unquarantine moves a file back to where it was found
+func unquarantine(m journalEntry) error {
+	if err := os.MkdirAll(filepath.Dir(m.Original), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(m.Quarantine, m.Original, m.Entry); err != nil {
+		return err
+	}
+	return storage.ApplyEntry(m.Original, m.Entry)
+}
+
+// moveFile renames src to dst, or copies it with the metadata of e and
+// removes src when they are on different filesystems
+func moveFile(src, dst string, e storage.Entry) error {
+	err := os.Rename(src, dst)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".consolidate-move-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = storage.ApplyEntry(tmp.Name(), e)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
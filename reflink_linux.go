@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which shares the extents of one file with
+// another on filesystems such as btrfs and xfs
+const ficlone = 0x40049409
+
+// reflink creates dest as a copy-on-write clone of src
+func reflink(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	err = out.Close()
+	if errno != 0 {
+		_ = os.Remove(dest)
+		return &os.LinkError{Op: "reflink", Old: src, New: dest, Err: errno}
+	}
+	return err
+}
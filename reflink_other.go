@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func reflink(src, dest string) error {
+	return fmt.Errorf("reflinks are not supported on this platform")
+}
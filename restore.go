@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// conflict policies for restoring onto a file that already exists
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+func restoreMain(c *cli.Context) error {
+	target := c.String("target")
+	if target == "" {
+		if err := cli.ShowCommandHelp(c, "restore"); err != nil {
+			return err
+		}
+		return usageError(fmt.Errorf("no target folder specified"))
+	}
+	policy := c.String("conflict")
+	switch policy {
+	case conflictSkip, conflictOverwrite, conflictRename:
+	default:
+		return usageError(fmt.Errorf("unknown conflict policy %q", policy))
+	}
+	sel := selection{Prefix: c.String("prefix"), Glob: c.String("glob"), Tag: c.String("tag")}
+	if sel.Glob != "" {
+		if _, err := path.Match(sel.Glob, ""); err != nil {
+			return usageError(fmt.Errorf("bad glob %q: %v", sel.Glob, err))
+		}
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	if ref := c.String("snapshot"); ref != "" {
+		snap, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		sel.Snapshot = &snap
+	}
+
+	found := sel.find(repo)
+	if c.Bool("canonical") {
+		found = canonicalOnly(found)
+	}
+
+	verbose := c.GlobalBool("verbose")
+	var failed int
+	for _, item := range found {
+		dest, err := restorePath(target, item.E)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERR: %v\n", err)
+			failed++
+			continue
+		}
+		dest, ok := resolveConflict(dest, policy)
+		if !ok {
+			if verbose {
+				fmt.Printf("LOG: skipped: %s\n", dest)
+			}
+			continue
+		}
+		if err = restoreFile(dest, item.O, item.E); err != nil {
+			fmt.Fprintf(os.Stderr, "ERR: %s: %v\n", item.E.Name, err)
+			failed++
+			continue
+		}
+		if verbose {
+			fmt.Printf("LOG: restored: %s\n", dest)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be restored", failed)
+	}
+	return nil
+}
+
+// selection picks names out of a repository, or out of one snapshot of
+// it; every criterion that is set must match
+type selection struct {
+	Prefix   string
+	Glob     string
+	Tag      string
+	Snapshot *storage.Snapshot
+}
+
+// selected is one name of an object chosen by a selection
+type selected struct {
+	O storage.Object
+	E storage.Entry
+}
+
+func (s selection) matches(name string) bool {
+	if s.Prefix != "" && !strings.HasPrefix(name, s.Prefix) {
+		return false
+	}
+	if s.Glob != "" {
+		if ok, _ := path.Match(s.Glob, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the selected names of r, ordered by name
+func (s selection) find(r storage.Repository) []selected {
+	if s.Snapshot != nil {
+		return s.findInSnapshot(r)
+	}
+
+	var objects []storage.Object
+	if s.Tag != "" {
+		objects = r.ObjectsByTag(s.Tag)
+	} else {
+		seen := map[storage.ID]bool{}
+		for _, name := range r.AllNames() {
+			if !s.matches(name) {
+				continue
+			}
+			for _, obj := range r.ObjectsByName(name) {
+				if !seen[obj.Hash()] {
+					seen[obj.Hash()] = true
+					objects = append(objects, obj)
+				}
+			}
+		}
+	}
+
+	found := []selected{}
+	for _, obj := range objects {
+		for _, e := range obj.Entries() {
+			if s.matches(e.Name) {
+				found = append(found, selected{O: obj, E: e})
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].E.Name < found[j].E.Name })
+	return found
+}
+
+// findInSnapshot returns the selected names as they were when the
+// snapshot was taken
+func (s selection) findInSnapshot(r storage.Repository) []selected {
+	found := []selected{}
+	objects := map[storage.ID]storage.Object{}
+	for _, name := range s.Snapshot.Names() {
+		if !s.matches(name) {
+			continue
+		}
+		id := s.Snapshot.Files[name]
+		obj, ok := objects[id]
+		if !ok {
+			if obj = r.Object(id); obj == nil {
+				continue
+			}
+			objects[id] = obj
+		}
+		if s.Tag != "" && !hasString(obj.Tags(), s.Tag) {
+			continue
+		}
+		e := storage.Entry{Name: name, UID: -1, GID: -1}
+		for _, entry := range obj.Entries() {
+			if entry.Name == name {
+				e = entry
+			}
+		}
+		found = append(found, selected{O: obj, E: e})
+	}
+	return found
+}
+
+// canonicalOnly keeps one name of each object: its canonical name when
+// that was selected, and the first selected name otherwise
+func canonicalOnly(found []selected) []selected {
+	names := map[storage.ID][]string{}
+	for _, item := range found {
+		names[item.O.Hash()] = append(names[item.O.Hash()], item.E.Name)
+	}
+	kept := []selected{}
+	for _, item := range found {
+		id := item.O.Hash()
+		list, ok := names[id]
+		if !ok {
+			continue
+		}
+		if name := canonicalOf(item.O, list); name == "" || name == item.E.Name {
+			kept = append(kept, item)
+			delete(names, id)
+		}
+	}
+	return kept
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// restorePath places e under target at its recorded name, which already
+// begins with the folder of the root it was found under. The name is
+// cleaned as if absolute, so that it cannot climb out of target
+func restorePath(target string, e storage.Entry) (string, error) {
+	rel := path.Clean("/" + e.Name)
+	if rel == "/" {
+		return "", fmt.Errorf("nothing to restore for %q", e.Name)
+	}
+	return filepath.Join(target, filepath.FromSlash(rel)), nil
+}
+
+// resolveConflict applies policy when dest already exists; it returns the
+// path to write to, and false if the file should be skipped
+func resolveConflict(dest string, policy string) (string, bool) {
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		return dest, true
+	}
+	switch policy {
+	case conflictOverwrite:
+		return dest, true
+	case conflictRename:
+		ext := filepath.Ext(dest)
+		base := strings.TrimSuffix(dest, ext)
+		for i := 1; ; i++ {
+			candidate := base + "." + strconv.Itoa(i) + ext
+			if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+				return candidate, true
+			}
+		}
+	}
+	return dest, false
+}
+
+// restoreFile writes the content of o to dest with the metadata of e. The
+// data goes to a temporary file first so an existing dest is only
+// replaced once the new content is complete
+func restoreFile(dest string, o storage.Object, e storage.Entry) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".consolidate-restore-")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	err = o.WriteData(tmp, true)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = storage.ApplyEntry(name, e)
+	}
+	if err == nil {
+		err = os.Rename(name, dest)
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
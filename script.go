@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// scriptRemove is the script mode that deletes copies outright
+const scriptRemove = "remove"
+
+func scriptMain(c *cli.Context) error {
+	mode := c.String("mode")
+	switch mode {
+	case linkHard, linkSymlink, scriptRemove, modeQuarantine:
+	default:
+		return usageError(fmt.Errorf("unknown script mode %q", mode))
+	}
+	minSize, err := storage.ParseSize(c.String("min-size"))
+	if err != nil {
+		return usageError(err)
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var snap *storage.Snapshot
+	if ref := c.String("snapshot"); ref != "" {
+		s, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		snap = &s
+	}
+	groups, err := findDupes(repo, snap, minSize)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Names[0] < groups[j].Names[0] })
+
+	var w io.Writer = os.Stdout
+	if out := c.String("output"); out != "" {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	s := script{W: w, Mode: mode, Quarantine: c.String("quarantine"), plain: plainSHA256(repo)}
+	s.header(len(groups))
+	for _, g := range groups {
+		s.group(g)
+	}
+	return s.err
+}
+
+// plainSHA256 reports whether content ids of r are SHA-256 digests of the
+// content, which the script can then check directly
+func plainSHA256(r storage.Repository) bool {
+	if enc, ok := r.(storage.Encryptable); ok && enc.Key() != nil {
+		return false
+	}
+	return r.HashAlgorithm() == storage.SHA256
+}
+
+// script writes a dedupe plan as a POSIX shell script in which every step
+// first checks that the files involved still hold the expected content
+type script struct {
+	W          io.Writer
+	Mode       string
+	Quarantine string
+
+	plain bool
+	err   error
+}
+
+const scriptFunctions = `set -u
+
+# digest FILE prints the SHA-256 of FILE
+digest() {
+	if command -v sha256sum >/dev/null 2>&1; then
+		sha256sum < "$1" | cut -d ' ' -f 1
+	else
+		shasum -a 256 < "$1" | cut -d ' ' -f 1
+	fi
+}
+
+# check FILE SIZE SHA256 fails unless FILE is a regular file that still
+# holds the expected content
+check() {
+	if [ -f "$1" ] && [ ! -L "$1" ] &&
+		[ "$(wc -c < "$1" | tr -d ' ')" = "$2" ] &&
+		[ "$(digest "$1")" = "$3" ]; then
+		return 0
+	fi
+	echo "skipped: $1 has changed" >&2
+	return 1
+}
+`
+
+func (s *script) printf(format string, args ...interface{}) {
+	if s.err == nil {
+		_, s.err = fmt.Fprintf(s.W, format, args...)
+	}
+}
+
+func (s *script) header(groups int) {
+	s.printf("#!/bin/sh\n")
+	s.printf("# %s plan for %d duplicate group(s), written by consolidate on %s\n", s.Mode, groups, time.Now().Format(time.RFC3339))
+	s.printf("# review every step before running it\n")
+	if s.Mode == linkHard {
+		s.printf("# hard links share the mode, owner and times of the copy that is kept\n")
+	}
+	if s.Mode == modeQuarantine {
+		s.printf("# every move is journalled in %s so that undo can put it back\n", quote(journal{Dir: s.Quarantine}.path()))
+	}
+	s.printf("\n%s", scriptFunctions)
+}
+
+// group writes the steps for g: the canonical name is kept and every other
+// name is replaced or moved
+func (s *script) group(g dupeGroup) {
+	sum, err := s.sha256(g)
+	if err != nil {
+		s.printf("\n# %s: %v\n", g.ID, err)
+		return
+	}
+	keep := g.Canonical
+	if keep == "" {
+		keep = g.Names[0]
+	}
+
+	s.printf("\n# %s: %d copies of %d bytes, %d bytes wasted\n", g.ID, len(g.Names), g.Size, g.Wasted)
+	if sum != g.ID.String() {
+		s.printf("# sha256 %s\n", sum)
+	}
+	s.printf("# keep %s\n", quote(keep))
+	for _, name := range g.Names {
+		if name == keep {
+			continue
+		}
+		step, err := s.step(g, keep, name)
+		if err != nil {
+			s.printf("# %s: %v\n", name, err)
+			continue
+		}
+		s.printf("# %s %s (%d bytes)\n", s.Mode, quote(name), g.Size)
+		s.printf("check %s %d %s && check %s %d %s && %s\n",
+			quote(keep), g.Size, sum, quote(name), g.Size, sum, step)
+	}
+}
+
+// step is the command that dedupes name, a copy in g, against keep
+func (s *script) step(g dupeGroup, keep, name string) (string, error) {
+	switch s.Mode {
+	case linkHard:
+		return "ln -f -- " + quote(keep) + " " + quote(name), nil
+	case linkSymlink:
+		target, err := filepath.Abs(keep)
+		if err != nil {
+			return "", err
+		}
+		return "ln -sf -- " + quote(target) + " " + quote(name), nil
+	case modeQuarantine:
+		return s.quarantine(g, keep, name)
+	}
+	return "rm -f -- " + quote(name), nil
+}
+
+// quarantine is the command that moves name under the quarantine folder.
+// It appends the move to the journal first, in the form undo and purge
+// read, and never moves name over a file already there
+func (s *script) quarantine(g dupeGroup, keep, name string) (string, error) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return "", err
+	}
+	j := journal{Dir: s.Quarantine}
+	m, err := j.entry(name, fi, g, keep)
+	if err != nil {
+		return "", err
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	journalPath, err := filepath.Abs(j.path())
+	if err != nil {
+		return "", err
+	}
+	dest := quote(m.Quarantine)
+	return "mkdir -p -- " + quote(filepath.Dir(m.Quarantine)) +
+		" && [ ! -e " + dest + " ] && [ ! -L " + dest + " ]" +
+		" && printf '%s\\n' " + quote(string(line)) + " >> " + quote(journalPath) +
+		" && mv -n -- " + quote(name) + " " + dest, nil
+}
+
+// sha256 returns the SHA-256 of the content of g, read back from the
+// repository unless the content id already is one
+func (s *script) sha256(g dupeGroup) (string, error) {
+	if s.plain {
+		return g.ID.String(), nil
+	}
+	h := sha256.New()
+	if err := g.Object.WriteData(h, true); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// quote makes s a single shell word
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func semanticMain(c *cli.Context) error {
+	write, ok := nearWriters[c.String("format")]
+	if !ok {
+		return usageError(fmt.Errorf("unknown format %q", c.String("format")))
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	var snap *storage.Snapshot
+	if ref := c.String("snapshot"); ref != "" {
+		s, err := findSnapshot(repo, ref)
+		if err != nil {
+			return err
+		}
+		snap = &s
+	}
+
+	objects, names, err := namedObjects(repo, snap)
+	if err != nil {
+		return err
+	}
+	return write(os.Stdout, sameGroups(objects, names, storage.Essence), "file(s)")
+}
+
+// sameGroups gathers distinct objects that share a kind fingerprint, and
+// returns the groups with more than one member, largest first
+func sameGroups(objects []storage.Object, names map[storage.ID][]string, kind storage.Fingerprint) []nearGroup {
+	byPrint := map[string][]nearMember{}
+	for _, obj := range objects {
+		fp, ok := obj.Fingerprints()[kind]
+		if !ok {
+			continue
+		}
+		list := append([]string{}, names[obj.Hash()]...)
+		sort.Strings(list)
+		byPrint[fp] = append(byPrint[fp], nearMember{ID: obj.Hash(), Fingerprint: fp, Size: obj.Size(), Names: list})
+	}
+
+	groups := []nearGroup{}
+	for _, members := range byPrint {
+		if len(members) < 2 {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+		groups = append(groups, nearGroup{Members: members})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Members) != len(groups[j].Members) {
+			return len(groups[i].Members) > len(groups[j].Members)
+		}
+		return groups[i].Members[0].ID < groups[j].Members[0].ID
+	})
+	return groups
+}
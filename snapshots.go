@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func snapshotsMain(c *cli.Context) error {
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+
+	if c.NArg() > 0 {
+		snap, err := findSnapshot(repo, c.Args().First())
+		if err != nil {
+			return err
+		}
+		for _, name := range snap.Names() {
+			fmt.Printf("%s  %s\n", snap.Files[name], name)
+		}
+		return nil
+	}
+
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		tags := ""
+		if len(s.Tags) > 0 {
+			tags = "  [" + strings.Join(s.Tags, ", ") + "]"
+		}
+		fmt.Printf("%s  %s  %-16s %s%s\n", s.ID, s.Time.Format(time.RFC3339), s.Host, strings.Join(s.Roots, " "), tags)
+	}
+	return nil
+}
+
+// findSnapshot resolves ref to a snapshot with its files. ref is either
+// "latest" or a unique prefix of a snapshot id
+func findSnapshot(r storage.Repository, ref string) (storage.Snapshot, error) {
+	snaps, err := r.Snapshots()
+	if err != nil {
+		return storage.Snapshot{}, err
+	}
+	if ref == "latest" {
+		if len(snaps) == 0 {
+			return storage.Snapshot{}, fmt.Errorf("no snapshots")
+		}
+		return r.Snapshot(snaps[len(snaps)-1].ID)
+	}
+
+	var match []string
+	for _, s := range snaps {
+		if strings.HasPrefix(s.ID, ref) {
+			match = append(match, s.ID)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return storage.Snapshot{}, fmt.Errorf("no snapshot matches %q", ref)
+	case 1:
+		return r.Snapshot(match[0])
+	}
+	return storage.Snapshot{}, fmt.Errorf("%q matches %d snapshots", ref, len(match))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func statsMain(c *cli.Context) error {
+	write, ok := statsWriters[c.String("format")]
+	if !ok {
+		return usageError(fmt.Errorf("unknown format %q", c.String("format")))
+	}
+
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	st, err := repo.Stats()
+	if err != nil {
+		return err
+	}
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	r := repoStats{
+		Repo:           c.GlobalString("repo"),
+		Hash:           repo.HashAlgorithm(),
+		Snapshots:      len(snaps),
+		Objects:        st.Objects,
+		Names:          st.Names,
+		Tags:           st.Tags,
+		Chunks:         st.Chunks,
+		Size:           st.Size,
+		CompressedSize: st.CompressedSize,
+	}
+	if enc, ok := repo.(storage.Encryptable); ok {
+		r.Encrypted = enc.Encrypted()
+	}
+	return write(os.Stdout, r)
+}
+
+// repoStats is what stats reports about a repository
+type repoStats struct {
+	Repo           string                `json:"repo"`
+	Hash           storage.HashAlgorithm `json:"hash"`
+	Encrypted      bool                  `json:"encrypted"`
+	Snapshots      int                   `json:"snapshots"`
+	Objects        int                   `json:"objects"`
+	Names          int                   `json:"names"`
+	Tags           int                   `json:"tags"`
+	Chunks         int                   `json:"chunks"`
+	Size           uint64                `json:"size"`
+	CompressedSize uint64                `json:"compressed_size"`
+}
+
+var statsWriters = map[string]func(io.Writer, repoStats) error{
+	"text": writeStatsText,
+	"json": writeStatsJSON,
+}
+
+func writeStatsText(w io.Writer, r repoStats) error {
+	saved := 0.0
+	if r.Size > 0 {
+		saved = 100 * (1 - float64(r.CompressedSize)/float64(r.Size))
+	}
+	_, err := fmt.Fprintf(w, "repository  %s\nhash        %s\nencrypted   %t\nsnapshots   %d\nobjects     %d\nnames       %d\ntags        %d\nchunks      %d\nsize        %d\nstored      %d (%.1f%% saved)\n",
+		r.Repo, r.Hash, r.Encrypted, r.Snapshots, r.Objects, r.Names, r.Tags, r.Chunks, r.Size, r.CompressedSize, saved)
+	return err
+}
+
+func writeStatsJSON(w io.Writer, r repoStats) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
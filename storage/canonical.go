@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Rule compares two names of the same content. It returns a negative
+// number when a makes the better canonical copy, a positive number when b
+// does, and zero when it cannot tell them apart
+type Rule func(a, b Entry) int
+
+// Rules pick the canonical copy among the names of an object. They are
+// applied in order until one tells two names apart; names no rule can
+// separate are ordered by name
+type Rules []Rule
+
+// Less reports whether a is preferred to b
+func (rs Rules) Less(a, b Entry) bool {
+	for _, rule := range rs {
+		if c := rule(a, b); c != 0 {
+			return c < 0
+		}
+	}
+	return a.Name < b.Name
+}
+
+// Choose returns the preferred entry, or false if there are none
+func (rs Rules) Choose(entries []Entry) (Entry, bool) {
+	if len(entries) == 0 {
+		return Entry{}, false
+	}
+	best := entries[0]
+	for _, e := range entries[1:] {
+		if rs.Less(e, best) {
+			best = e
+		}
+	}
+	return best, true
+}
+
+// copyName matches the names file managers give to copies with the word
+// copy in them, such as "a copy.txt", "a - Copy (2).txt" and "Copy of
+// a.txt"
+var copyName = regexp.MustCompile(`(?i)(^copy( \(\d+\))? of |[ _-]+copy( ?\(?\d+\)?)?$)`)
+
+// numberedName matches names numbered the way copies are, such as
+// "a (1).txt"; since "Report (3).pdf" or "Vacation (2019).jpg" may well be
+// originals, only a small number counts, and only beside the same name
+// without it
+var numberedName = regexp.MustCompile(`^(.*?) ?\(([1-9]\d?)\)$`)
+
+// isCopyOf reports whether name looks like a copy, either by its name
+// alone or as a numbered copy of other
+func isCopyOf(name, other string) bool {
+	stem := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	if copyName.MatchString(stem) {
+		return true
+	}
+	m := numberedName.FindStringSubmatch(stem)
+	if m == nil || path.Dir(name) != path.Dir(other) || path.Ext(name) != path.Ext(other) {
+		return false
+	}
+	return m[1] == strings.TrimSuffix(path.Base(other), path.Ext(other))
+}
+
+// ParseRule reads one rule:
+//
+//	root:DIR     prefer names under DIR
+//	oldest       prefer the oldest modification time
+//	shortest     prefer the shortest path
+//	no-copy      avoid names like "a copy.txt", or "a (1).txt" beside "a.txt"
+//	match:REGEX  prefer names matching REGEX
+//	avoid:REGEX  avoid names matching REGEX
+func ParseRule(spec string) (Rule, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "root":
+		if arg == "" {
+			return nil, fmt.Errorf("rule %q: missing folder", spec)
+		}
+		root := path.Clean(arg)
+		return prefer(func(e Entry) bool {
+			return e.Name == root || strings.HasPrefix(e.Name, root+"/")
+		}), nil
+	case "oldest":
+		return func(a, b Entry) int {
+			switch {
+			case a.ModTime.Equal(b.ModTime):
+				return 0
+			case b.ModTime.IsZero(), !a.ModTime.IsZero() && a.ModTime.Before(b.ModTime):
+				return -1
+			}
+			return 1
+		}, nil
+	case "shortest":
+		return func(a, b Entry) int { return len(a.Name) - len(b.Name) }, nil
+	case "no-copy":
+		return func(a, b Entry) int {
+			switch copyA, copyB := isCopyOf(a.Name, b.Name), isCopyOf(b.Name, a.Name); {
+			case copyA == copyB:
+				return 0
+			case copyB:
+				return -1
+			}
+			return 1
+		}, nil
+	case "match", "avoid":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", spec, err)
+		}
+		if kind == "avoid" {
+			return prefer(func(e Entry) bool { return !re.MatchString(e.Name) }), nil
+		}
+		return prefer(func(e Entry) bool { return re.MatchString(e.Name) }), nil
+	}
+	return nil, fmt.Errorf("unknown rule %q", spec)
+}
+
+// ParseRules reads rules in order of precedence
+func ParseRules(specs []string) (Rules, error) {
+	rules := Rules{}
+	for _, spec := range specs {
+		rule, err := ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// prefer turns a test into a rule that prefers names passing it
+func prefer(ok func(Entry) bool) Rule {
+	return func(a, b Entry) int {
+		switch okA, okB := ok(a), ok(b); {
+		case okA == okB:
+			return 0
+		case okA:
+			return -1
+		}
+		return 1
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import "io"
+
+// Content defined chunking parameters. Boundaries depend on these and on
+// the gear table, so changing any of them stops new chunks from
+// de-duplicating against chunks already stored
+const (
+	chunkMin = 256 << 10
+	chunkAvg = 1 << 20
+	chunkMax = 4 << 20
+
+	// normalized chunking: a stricter mask below the average size and a
+	// looser one above it keeps chunk sizes close to chunkAvg
+	chunkMaskS = uint64(1<<22-1) << (64 - 22)
+	chunkMaskL = uint64(1<<18-1) << (64 - 18)
+)
+
+var gear = gearTable()
+
+// gearTable fills the FastCDC gear table from a fixed splitmix64 sequence
+func gearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x636f6e736f6c6964) // "consolid"
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// chunker splits a stream into content defined chunks using FastCDC
+type chunker struct {
+	r        io.Reader
+	buf      []byte
+	off, end int
+	eof      bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, chunkMax)}
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted. The
+// returned slice is only valid until the following call to Next
+func (c *chunker) Next() ([]byte, error) {
+	if c.off > 0 {
+		c.end = copy(c.buf, c.buf[c.off:c.end])
+		c.off = 0
+	}
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	c.off = cutPoint(c.buf[:c.end])
+	return c.buf[:c.off], nil
+}
+
+// cutPoint returns the length of the first chunk in data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= chunkMin {
+		return n
+	}
+	if n > chunkMax {
+		n = chunkMax
+	}
+	normal := chunkAvg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := chunkMin
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
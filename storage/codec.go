@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names the compression applied to the stored data of a chunk
+type Codec string
+
+// Known codecs
+const (
+	CodecNone Codec = "none"
+	CodecZlib Codec = "zlib"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+	CodecLZ4  Codec = "lz4"
+)
+
+// DefaultCodec is used when no codec is chosen; it is also the codec of
+// every chunk written before codecs were recorded
+const DefaultCodec = CodecZlib
+
+// DefaultMinSavings is the fraction of its size a chunk must shrink by for
+// the compressed form to be kept
+const DefaultMinSavings = 0.05
+
+type codecStrategy struct {
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecStrategies = map[Codec]codecStrategy{
+	CodecNone: {
+		compress:   func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		decompress: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil },
+	},
+	CodecZlib: {
+		compress:   func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		decompress: zlib.NewReader,
+	},
+	CodecGzip: {
+		compress:   func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		decompress: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	CodecZstd: {
+		compress:   newZstdWriter,
+		decompress: newZstdReader,
+	},
+	CodecLZ4: {
+		compress:   func(w io.Writer) (io.WriteCloser, error) { return &lz4Writer{w: w}, nil },
+		decompress: newLZ4Reader,
+	},
+}
+
+// ParseCodec validates the name of a codec
+func ParseCodec(name string) (Codec, error) {
+	codec := Codec(name)
+	if _, ok := codecStrategies[codec]; !ok {
+		return "", fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+func (c Codec) String() string { return string(c) }
+
+// NewWriter returns a writer that compresses into w
+func (c Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	s, ok := codecStrategies[c]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q", string(c))
+	}
+	return s.compress(w)
+}
+
+// NewReader returns a reader that decompresses r
+func (c Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	s, ok := codecStrategies[c]
+	if !ok {
+		return nil, fmt.Errorf("unsupported codec %q", string(c))
+	}
+	return s.decompress(r)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newZstdWriter writes a zstd frame; a chunk is compressed on its own, so
+// one goroutine is enough
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// lz4Writer collects a chunk and writes it out as a single LZ4 block when
+// closed. Chunks are at most chunkMax bytes, so the buffer stays bounded
+type lz4Writer struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (z *lz4Writer) Write(p []byte) (int, error) { return z.buf.Write(p) }
+
+func (z *lz4Writer) Close() error {
+	block, err := lz4.Encode(nil, z.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = z.w.Write(block)
+	return err
+}
+
+func newLZ4Reader(r io.Reader) (io.ReadCloser, error) {
+	block, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := lz4.Decode(nil, block)
+	if err != nil {
+		return nil, fmt.Errorf("lz4: %v", err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// compressedSignatures are the leading bytes of formats that are already
+// compressed and not worth compressing again
+var compressedSignatures = []struct {
+	offset int
+	magic  []byte
+}{
+	{0, []byte{0xff, 0xd8, 0xff}},                 // jpeg
+	{0, []byte{0x89, 'P', 'N', 'G'}},              // png
+	{0, []byte("GIF8")},                           // gif
+	{8, []byte("WEBP")},                           // webp
+	{4, []byte("ftyp")},                           // mp4, mov, heic
+	{0, []byte{0x1a, 0x45, 0xdf, 0xa3}},           // mkv, webm
+	{0, []byte("ID3")},                            // mp3
+	{0, []byte("OggS")},                           // ogg
+	{0, []byte("fLaC")},                           // flac
+	{0, []byte{'P', 'K', 0x03, 0x04}},             // zip, jar, docx
+	{0, []byte{0x1f, 0x8b}},                       // gzip
+	{0, []byte("BZh")},                            // bzip2
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},   // xz
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}},           // zstd
+	{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}}, // 7z
+	{0, []byte("Rar!")},                           // rar
+}
+
+// isCompressed reports whether head starts like an already compressed
+// file format
+func isCompressed(head []byte) bool {
+	for _, sig := range compressedSignatures {
+		if len(head) >= sig.offset+len(sig.magic) &&
+			bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return true
+		}
+	}
+	return false
+}
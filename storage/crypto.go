@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key is the master key of an encrypted repository. The sub keys used for
+// chunk data, content ids and names are derived from it
+type Key struct {
+	data      cipher.AEAD
+	name      cipher.AEAD
+	nameNonce []byte
+	id        []byte
+}
+
+func newKey(master []byte) (*Key, error) {
+	var err error
+	k := &Key{
+		id:        deriveKey(master, "id"),
+		nameNonce: deriveKey(master, "name-nonce"),
+	}
+	if k.data, err = newAEAD(deriveKey(master, "data")); err != nil {
+		return nil, err
+	}
+	if k.name, err = newAEAD(deriveKey(master, "name")); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	_, _ = mac.Write([]byte("consolidate " + purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyedHash returns the hash of algo keyed for content ids, so that ids do
+// not reveal which well known files a repository holds
+func (k *Key) keyedHash(algo HashAlgorithm) (hash.Hash, error) {
+	fn, ok := hashStrategies[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", string(algo))
+	}
+	return hmac.New(fn, k.id), nil
+}
+
+// Seal encrypts and authenticates chunk data with a random nonce
+func (k *Key) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.data.NonceSize(), k.data.NonceSize()+len(plaintext)+k.data.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.data.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open authenticates and decrypts data produced by Seal
+func (k *Key) Open(sealed []byte) ([]byte, error) {
+	n := k.data.NonceSize()
+	if len(sealed) < n+k.data.Overhead() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	return k.data.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// SealName encrypts a name or tag deterministically, so that equal names
+// still compare equal inside a repository
+func (k *Key) SealName(name string) string {
+	mac := hmac.New(sha256.New, k.nameNonce)
+	_, _ = mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:k.name.NonceSize()]
+	sealed := k.name.Seal(nonce, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// OpenName decrypts a name produced by SealName
+func (k *Key) OpenName(sealed string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	n := k.name.NonceSize()
+	if len(b) < n+k.name.Overhead() {
+		return "", fmt.Errorf("sealed name too short")
+	}
+	name, err := k.name.Open(nil, b[:n], b[n:], nil)
+	return string(name), err
+}
+
+// WrappedKey is a master key encrypted with a passphrase derived key, in
+// the form repositories store it
+type WrappedKey struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Key  []byte `json:"key"`
+}
+
+// scrypt cost parameters for newly wrapped keys
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// NewWrappedKey generates a master key and wraps it with passphrase
+func NewWrappedKey(passphrase []byte) (*WrappedKey, *Key, error) {
+	w := &WrappedKey{
+		Salt: make([]byte, 16),
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}
+	master := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, w.Salt); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, nil, err
+	}
+	kek, err := w.kek(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, kek.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	w.Key = kek.Seal(nonce, nonce, master, nil)
+
+	k, err := newKey(master)
+	return w, k, err
+}
+
+// ParseWrappedKey reads a WrappedKey from the form String produces
+func ParseWrappedKey(s string) (*WrappedKey, error) {
+	w := &WrappedKey{}
+	if err := json.Unmarshal([]byte(s), w); err != nil {
+		return nil, fmt.Errorf("reading wrapped key: %v", err)
+	}
+	return w, nil
+}
+
+func (w *WrappedKey) String() string {
+	b, _ := json.Marshal(w)
+	return string(b)
+}
+
+// Unwrap recovers the master key using passphrase
+func (w *WrappedKey) Unwrap(passphrase []byte) (*Key, error) {
+	kek, err := w.kek(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	n := kek.NonceSize()
+	if len(w.Key) < n+kek.Overhead() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	master, err := kek.Open(nil, w.Key[:n], w.Key[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	return newKey(master)
+}
+
+// kek derives the key encryption key from passphrase
+func (w *WrappedKey) kek(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, w.Salt, w.N, w.R, w.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif" // decoders for the formats DHash understands
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// maxImagePixels is the largest image dHash decodes; a small file can
+// claim dimensions that would need gigabytes to hold decoded
+const maxImagePixels = 64 << 20
+
+// dHash decodes an image, shrinks it to a 9x8 grayscale thumbnail and
+// sets one bit for each pixel that is brighter than its right neighbour
+func dHash(r io.ReadSeeker, _ Options) (string, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return "", fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return "", fmt.Errorf("empty image")
+	}
+	luma := lumaOf(img)
+
+	const w, h = 9, 8
+	var thumb [h][w]uint64
+	for ty := 0; ty < h; ty++ {
+		y0, y1 := span(b.Min.Y, b.Dy(), ty, h)
+		for tx := 0; tx < w; tx++ {
+			x0, x1 := span(b.Min.X, b.Dx(), tx, w)
+			var sum, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += uint64(luma(x, y))
+					n++
+				}
+			}
+			thumb[ty][tx] = sum / n
+		}
+	}
+
+	var sum uint64
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w-1; tx++ {
+			sum <<= 1
+			if thumb[ty][tx] > thumb[ty][tx+1] {
+				sum |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", sum), nil
+}
+
+// span returns the source rows or columns that make up cell i of n cells
+// covering size pixels from min; every cell covers at least one pixel
+func span(min, size, i, n int) (int, int) {
+	lo, hi := min+i*size/n, min+(i+1)*size/n
+	if hi <= lo {
+		hi = lo + 1
+	}
+	if hi > min+size {
+		lo, hi = min+size-1, min+size
+	}
+	return lo, hi
+}
+
+// lumaOf returns a function giving the brightness of a pixel of img,
+// reading the luma plane directly when the image has one
+func lumaOf(img image.Image) func(x, y int) uint32 {
+	switch m := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) uint32 { return uint32(m.Y[m.YOffset(x, y)]) << 8 }
+	case *image.Gray:
+		return func(x, y int) uint32 { return uint32(m.Pix[m.PixOffset(x, y)]) << 8 }
+	}
+	return func(x, y int) uint32 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+	}
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// Entry is the metadata recorded for one name of an Object. Content is
+// de-duplicated, so every name keeps its own permissions, times and owner
+type Entry struct {
+	Name    string
+	Root    string
+	Mode    os.FileMode
+	ModTime time.Time
+	UID     int
+	GID     int
+	Xattrs  map[string][]byte
+}
+
+// NewEntry captures the metadata of file, found under root
+func NewEntry(file string, root string, fi os.FileInfo) Entry {
+	e := Entry{
+		Name:    path.Clean(file),
+		Root:    path.Clean(root),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+		UID:     -1,
+		GID:     -1,
+	}
+	fillOwner(&e, fi)
+	e.Xattrs = readXattrs(e.Name)
+	return e
+}
+
+// ApplyEntry sets the recorded extended attributes, owner, mode and
+// modification time of e on file. The owner is only changed when the
+// process is allowed to do so
+func ApplyEntry(file string, e Entry) error {
+	if err := writeXattrs(file, e.Xattrs); err != nil {
+		return err
+	}
+	if err := applyOwner(file, e); err != nil {
+		return err
+	}
+	if e.Mode != 0 {
+		if err := os.Chmod(file, e.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if !e.ModTime.IsZero() {
+		return os.Chtimes(file, e.ModTime, e.ModTime)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+func fillOwner(e *Entry, fi os.FileInfo) {}
+
+func applyOwner(file string, e Entry) error { return nil }
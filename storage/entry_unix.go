@@ -0,0 +1,25 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func fillOwner(e *Entry, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.UID = int(st.Uid)
+		e.GID = int(st.Gid)
+	}
+}
+
+func applyOwner(file string, e Entry) error {
+	if e.UID < 0 && e.GID < 0 {
+		return nil
+	}
+	if err := os.Lchown(file, e.UID, e.GID); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
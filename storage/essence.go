@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// essence hashes the payload of a media file, leaving out the tags and
+// metadata that taggers and photo tools rewrite. It uses the content id
+// hash of opts, so it is keyed along with content ids
+func essence(r io.ReadSeeker, opts Options) (string, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	start, err := skipID3v2(r, size)
+	if err != nil {
+		return "", err
+	}
+	magic := make([]byte, 4)
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err = io.ReadFull(r, magic); err != nil {
+		return "", err
+	}
+
+	h, err := opts.newHash()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case start == 0 && isJPEG(magic):
+		if _, err = r.Seek(0, io.SeekStart); err == nil {
+			err = jpegEssence(r, h)
+		}
+	case bytes.Equal(magic, []byte("fLaC")):
+		err = flacEssence(r, h, size)
+	case isFrameSync(magic):
+		err = copyRange(r, h, start, trailingTags(r, start, size))
+	default:
+		err = fmt.Errorf("not a media file")
+	}
+	if err != nil {
+		return "", err
+	}
+	return NewID(h.Sum(nil)).String(), nil
+}
+
+func isMedia(head []byte) bool {
+	return isJPEG(head) || isFrameSync(head) ||
+		bytes.HasPrefix(head, []byte("ID3")) ||
+		bytes.HasPrefix(head, []byte("fLaC"))
+}
+
+func isJPEG(head []byte) bool {
+	return bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff})
+}
+
+// isFrameSync reports whether head starts with the header of an MPEG
+// audio frame: the sync word, then a version, layer, bitrate and sample
+// rate that are not reserved. ff fe is taken as the byte order mark of
+// UTF-16 text instead, though it could open a layer I frame
+func isFrameSync(head []byte) bool {
+	if len(head) < 4 || head[0] != 0xff || head[1]&0xe0 != 0xe0 || head[1] == 0xfe {
+		return false
+	}
+	version, layer := head[1]>>3&3, head[1]>>1&3
+	bitrate, rate := head[2]>>4, head[2]>>2&3
+	return version != 1 && layer != 0 && bitrate != 15 && rate != 3
+}
+
+// skipID3v2 returns the offset just past any ID3v2 tags at the start of r
+func skipID3v2(r io.ReadSeeker, size int64) (int64, error) {
+	var off int64
+	hdr := make([]byte, 10)
+	for off+10 <= size {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return 0, err
+		}
+		if !bytes.HasPrefix(hdr, []byte("ID3")) {
+			break
+		}
+		// the size is syncsafe: 7 bits in each of 4 bytes
+		n := int64(hdr[6]&0x7f)<<21 | int64(hdr[7]&0x7f)<<14 | int64(hdr[8]&0x7f)<<7 | int64(hdr[9]&0x7f)
+		off += 10 + n
+		if hdr[5]&0x10 != 0 {
+			off += 10 // footer
+		}
+	}
+	if off > size {
+		return 0, fmt.Errorf("truncated ID3v2 tag")
+	}
+	return off, nil
+}
+
+// trailingTags returns where the payload of r ends, before any ID3v1,
+// Lyrics3v2 and APE tags at the end of the file
+func trailingTags(r io.ReadSeeker, start, end int64) int64 {
+	read := func(off int64, n int) []byte {
+		if off < start {
+			return nil
+		}
+		b := make([]byte, n)
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return nil
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	if b := read(end-128, 3); bytes.Equal(b, []byte("TAG")) {
+		end -= 128
+	}
+	if b := read(end-15, 15); len(b) == 15 && bytes.Equal(b[6:], []byte("LYRICS200")) {
+		var n int64
+		if _, err := fmt.Sscanf(string(b[:6]), "%06d", &n); err == nil && end-15-n >= start {
+			end -= 15 + n
+		}
+	}
+	if b := read(end-32, 32); len(b) == 32 && bytes.Equal(b[:8], []byte("APETAGEX")) {
+		n := int64(binary.LittleEndian.Uint32(b[12:16]))
+		if binary.LittleEndian.Uint32(b[20:24])&(1<<31) != 0 {
+			n += 32 // header
+		}
+		if end-n >= start {
+			end -= n
+		}
+	}
+	return end
+}
+
+// jpegEssence copies every segment of a JPEG except the APP segments and
+// comments, followed by the image data
+func jpegEssence(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xff {
+			return fmt.Errorf("bad jpeg marker %#x", b)
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = br.ReadByte(); err != nil {
+				return err
+			}
+		}
+		switch {
+		case marker == 0xd9: // end of image
+			_, err = w.Write([]byte{0xff, marker})
+			return err
+		case marker == 0x01, marker >= 0xd0 && marker <= 0xd7: // no length
+			if _, err = w.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		length := make([]byte, 2)
+		if _, err = io.ReadFull(br, length); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint16(length)) - 2
+		if n < 0 {
+			return fmt.Errorf("bad jpeg segment length")
+		}
+		if marker >= 0xe0 && marker <= 0xef || marker == 0xfe { // APPn, COM
+			if _, err = io.CopyN(io.Discard, br, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = w.Write([]byte{0xff, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(w, br, n); err != nil {
+			return err
+		}
+		if marker == 0xda { // start of scan: the rest is image data
+			_, err = io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+// flacEssence copies the audio frames of a FLAC stream, skipping the
+// metadata blocks that follow the magic r has just read
+func flacEssence(r io.ReadSeeker, w io.Writer, size int64) error {
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return err
+		}
+		n := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		if _, err := r.Seek(n, io.SeekCurrent); err != nil {
+			return err
+		}
+		if hdr[0]&0x80 != 0 { // last metadata block
+			break
+		}
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if start > size {
+		return fmt.Errorf("truncated flac metadata")
+	}
+	return copyRange(r, w, start, trailingTags(r, start, size))
+}
+
+// copyRange copies the bytes of r from start up to end
+func copyRange(r io.ReadSeeker, w io.Writer, start, end int64) error {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, r, end-start)
+	return err
+}
@@ -1,6 +1,10 @@
 package factory
 
 import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/johnweldon/consolidate/storage"
@@ -9,13 +13,26 @@ import (
 // Registry holds the registered factory methods for Repositories
 var Registry = registrar{}
 
+// Options tell a factory which repository to open
+type Options struct {
+	// Path locates the repository, such as a database file or a
+	// directory; backends that keep nothing on disk ignore it
+	Path string
+	// Hash builds the content ids of a new repository; existing ones keep
+	// theirs, and "" means storage.DefaultHash
+	Hash storage.HashAlgorithm
+}
+
+// Factory opens the repository opts describe
+type Factory func(opts Options) (storage.Repository, error)
+
 type registrar struct {
 	sync.Mutex
 	once     sync.Once
-	registry map[string]func() storage.Repository
+	registry map[string]Factory
 }
 
-func (r *registrar) Add(name string, fn func() storage.Repository) {
+func (r *registrar) Add(name string, fn Factory) {
 	r.Lock()
 	defer r.Unlock()
 	r.once.Do(r.initialize)
@@ -23,17 +40,67 @@ func (r *registrar) Add(name string, fn func() storage.Repository) {
 	r.registry[name] = fn
 }
 
-func (r *registrar) Create(name string) storage.Repository {
+func (r *registrar) Create(name string, opts Options) (storage.Repository, error) {
+	r.Lock()
+	r.once.Do(r.initialize)
+	fn, ok := r.registry[name]
+	r.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, want one of %s", name, strings.Join(r.Names(), ", "))
+	}
+	return fn(opts)
+}
+
+// Open creates the repository a DSN such as "sqlite:///backups/photos.db"
+// names
+func (r *registrar) Open(dsn string) (storage.Repository, error) {
+	name, opts, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return r.Create(name, opts)
+}
+
+// Names lists the registered backends in order
+func (r *registrar) Names() []string {
 	r.Lock()
 	defer r.Unlock()
 	r.once.Do(r.initialize)
 
-	if fn, ok := r.registry[name]; ok {
-		return fn()
+	names := []string{}
+	for name := range r.registry {
+		names = append(names, name)
 	}
-	return nil
+	sort.Strings(names)
+	return names
 }
 
 func (r *registrar) initialize() {
-	r.registry = map[string]func() storage.Repository{}
+	r.registry = map[string]Factory{}
+}
+
+// ParseDSN splits a DSN into a backend name and its options. The path may
+// follow the backend as an absolute URL path, "sqlite:///backups/photos.db",
+// or directly, "sqlite:photos.db" or "sqlite://photos.db", for one relative
+// to the working directory
+func ParseDSN(dsn string) (string, Options, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", Options{}, fmt.Errorf("bad repository %q: %v", dsn, err)
+	}
+	if u.Scheme == "" {
+		return "", Options{}, fmt.Errorf("bad repository %q: want backend:path, e.g. sqlite:///backups/photos.db", dsn)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", Options{}, fmt.Errorf("bad repository %q: only a backend and a path are allowed", dsn)
+	}
+
+	opts := Options{Path: u.Host + u.Path}
+	if u.Opaque != "" {
+		if opts.Path, err = url.PathUnescape(u.Opaque); err != nil {
+			return "", Options{}, fmt.Errorf("bad repository %q: %v", dsn, err)
+		}
+	}
+	return strings.ToLower(u.Scheme), opts, nil
 }
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// Fingerprint names a secondary hash computed next to the content id.
+// Unlike the content id it is meant to match content that is similar,
+// rather than identical
+type Fingerprint string
+
+// Known fingerprints
+const (
+	// DHash is a 64 bit difference hash of a JPEG, PNG or GIF image;
+	// resized or re-encoded copies of a picture differ in few bits
+	DHash Fingerprint = "dhash"
+	// Essence hashes only the payload of a media file: MPEG audio frames
+	// without ID3 or APE tags, JPEG image data without APP segments or
+	// comments, and FLAC audio frames without metadata blocks
+	Essence Fingerprint = "essence"
+	// SimHash is a 64 bit similarity hash of a text file; documents that
+	// are mostly the same differ in few bits
+	SimHash Fingerprint = "simhash"
+)
+
+// DefaultFingerprints are computed by NewObject unless Options say
+// otherwise
+var DefaultFingerprints = []Fingerprint{DHash, Essence, SimHash}
+
+func (f Fingerprint) String() string { return string(f) }
+
+// fingerprintStrategies compute a fingerprint of the files whose leading
+// bytes they accept; a file they cannot make sense of gets none
+var fingerprintStrategies = map[Fingerprint]struct {
+	accepts func(head []byte) bool
+	sum     func(r io.ReadSeeker, opts Options) (string, error)
+}{
+	DHash:   {isImage, dHash},
+	Essence: {isMedia, essence},
+	SimHash: {isText, simHash},
+}
+
+// ParseFingerprint validates the name of a fingerprint
+func ParseFingerprint(name string) (Fingerprint, error) {
+	f := Fingerprint(name)
+	if _, ok := fingerprintStrategies[f]; !ok {
+		return "", fmt.Errorf("unknown fingerprint %q", name)
+	}
+	return f, nil
+}
+
+// fingerprints computes each fingerprint of opts that applies to the file
+// starting with head, reading it again from the start each time
+func fingerprints(r io.ReadSeeker, head []byte, opts Options) (map[Fingerprint]string, error) {
+	sums := map[Fingerprint]string{}
+	for _, kind := range opts.Fingerprints {
+		s, ok := fingerprintStrategies[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown fingerprint %q", kind)
+		}
+		if !s.accepts(head) {
+			continue
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if sum, err := s.sum(r, opts); err == nil {
+			sums[kind] = sum
+		}
+	}
+	return sums, nil
+}
+
+// Distance is the number of bits in which two 64 bit fingerprints differ
+func Distance(a, b string) (int, error) {
+	x, err := FingerprintBits(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := FingerprintBits(b)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
+
+// FingerprintBits returns the bits of a 64 bit fingerprint
+func FingerprintBits(s string) (uint64, error) {
+	x, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad fingerprint %q", s)
+	}
+	return x, nil
+}
+
+func isImage(head []byte) bool {
+	return bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff}) ||
+		bytes.HasPrefix(head, []byte{0x89, 'P', 'N', 'G'}) ||
+		bytes.HasPrefix(head, []byte("GIF8"))
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// HashAlgorithm names the function used to build content IDs
+type HashAlgorithm string
+
+// Known hash algorithms; FNV64a is only kept so repositories created
+// before content IDs were cryptographic can still be opened
+const (
+	FNV64a     HashAlgorithm = "fnv64a"
+	SHA256     HashAlgorithm = "sha256"
+	SHA512_256 HashAlgorithm = "sha512/256"
+)
+
+// DefaultHash is the algorithm used for newly created repositories
+const DefaultHash = SHA256
+
+var hashStrategies = map[HashAlgorithm]func() hash.Hash{
+	FNV64a:     func() hash.Hash { return fnv.New64a() },
+	SHA256:     sha256.New,
+	SHA512_256: sha512.New512_256,
+}
+
+// ParseHashAlgorithm validates the name of a hash algorithm
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	algo := HashAlgorithm(name)
+	if _, ok := hashStrategies[algo]; !ok {
+		return "", fmt.Errorf("unknown hash algorithm %q", name)
+	}
+	return algo, nil
+}
+
+// New returns a fresh hash.Hash for the algorithm
+func (a HashAlgorithm) New() (hash.Hash, error) {
+	fn, ok := hashStrategies[a]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", string(a))
+	}
+	return fn(), nil
+}
+
+func (a HashAlgorithm) String() string { return string(a) }
+
+// Writable reports whether new content may be stored under ids of a.
+// FNV-64a ids are too narrow to rule out two files sharing one, so
+// repositories that use them are only read
+func (a HashAlgorithm) Writable() bool { return a != FNV64a }
+
+// ID is the hex encoded content hash that identifies an Object
+type ID string
+
+// NewID builds an ID from a raw digest
+func NewID(sum []byte) ID { return ID(hex.EncodeToString(sum)) }
+
+func (id ID) String() string { return string(id) }
+
+// HashFile returns the content id the data of file would be stored under
+// with opts, without storing it
+func HashFile(file string, opts Options) (ID, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h, err := opts.newHash()
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return NewID(h.Sum(nil)), nil
+}
@@ -1,7 +1,9 @@
 package memory
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 
@@ -10,27 +12,121 @@ import (
 )
 
 func init() {
-	factory.Registry.Add("memory", newRepository)
+	factory.Registry.Add("memory", openMemory)
 }
 
-func newRepository() storage.Repository {
+// openMemory keeps a repository for as long as the process runs; it has
+// no path
+func openMemory(opts factory.Options) (storage.Repository, error) {
+	r := newRepository()
+	if opts.Hash != "" {
+		if !opts.Hash.Writable() {
+			return nil, fmt.Errorf("memory repositories cannot use %s content ids", opts.Hash)
+		}
+		r.hash = opts.Hash
+	}
+	return r, nil
+}
+
+func newRepository() *repository {
 	return &repository{
-		Objects: map[uint64]storage.Object{},
-		Names:   map[string]map[uint64]storage.Object{},
-		Tags:    map[string]map[uint64]storage.Object{},
+		hash:    storage.DefaultHash,
+		Chunks:  map[storage.ID]*chunk{},
+		Objects: map[storage.ID]storage.Object{},
+		Names:   map[string]map[storage.ID]storage.Object{},
+		Tags:    map[string]map[storage.ID]storage.Object{},
+
+		History: map[string]storage.Snapshot{},
+		Stat:    map[string]cachedStat{},
 	}
 }
 
 type repository struct {
 	sync.Mutex
+	hash           storage.HashAlgorithm
+	wrapped        *storage.WrappedKey
+	key            *storage.Key
 	originalSize   uint64
 	compressedSize uint64
-	Objects        map[uint64]storage.Object
-	Names          map[string]map[uint64]storage.Object
-	Tags           map[string]map[uint64]storage.Object
+	Chunks         map[storage.ID]*chunk
+	Objects        map[storage.ID]storage.Object
+	Names          map[string]map[storage.ID]storage.Object
+	Tags           map[string]map[storage.ID]storage.Object
+
+	History map[string]storage.Snapshot
+	Stat    map[string]cachedStat
+}
+
+// cachedStat is the stat a name had when it was read and the content found
+type cachedStat struct {
+	stat storage.FileStat
+	id   storage.ID
+}
+
+// chunk is the stored data of a storage.Chunk shared by refs objects
+type chunk struct {
+	size uint64
+	data []byte
+	refs int
+}
+
+func (r *repository) HashAlgorithm() storage.HashAlgorithm {
+	if r == nil {
+		return ""
+	}
+	return r.hash
+}
+
+// Encrypt seals chunk data; names are never persisted by this repository,
+// so they are kept in the clear regardless of names
+func (r *repository) Encrypt(passphrase []byte, names bool) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.wrapped != nil {
+		return fmt.Errorf("repository is already encrypted")
+	}
+	if len(r.Objects) > 0 {
+		return fmt.Errorf("only an empty repository can be encrypted")
+	}
+	w, k, err := storage.NewWrappedKey(passphrase)
+	if err != nil {
+		return err
+	}
+	r.wrapped, r.key = w, k
+	return nil
+}
+
+func (r *repository) Unseal(passphrase []byte) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.wrapped == nil {
+		return fmt.Errorf("repository is not encrypted")
+	}
+	k, err := r.wrapped.Unwrap(passphrase)
+	if err != nil {
+		return err
+	}
+	r.key = k
+	return nil
+}
+
+func (r *repository) Encrypted() bool { return r != nil && r.wrapped != nil }
+func (r *repository) Key() *storage.Key {
+	if r == nil {
+		return nil
+	}
+	return r.key
 }
 
-func (r *repository) Object(key uint64) storage.Object {
+func (r *repository) Object(key storage.ID) storage.Object {
 	if r == nil {
 		return nil
 	}
@@ -40,6 +136,17 @@ func (r *repository) Object(key uint64) storage.Object {
 	return r.Objects[key]
 }
 
+func (r *repository) Has(key storage.ID) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	_, ok := r.Objects[key]
+	return ok
+}
+
 func (r *repository) AllNames() []string {
 	if r == nil {
 		return nil
@@ -80,11 +187,71 @@ func (r *repository) ObjectsByTag(tag string) []storage.Object {
 	return listObjects(tag, r.Tags)
 }
 
+func (r *repository) Find(q storage.Query) ([]storage.Object, error) {
+	if r == nil {
+		return nil, fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	found := []storage.Object{}
+	for _, o := range r.Objects {
+		if storage.MatchAny(q, o) {
+			found = append(found, o)
+		}
+	}
+	return found, nil
+}
+
+// Iterate works on a copy of the object list, so fn may use the repository
+func (r *repository) Iterate(fn func(storage.Object) error) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	objects := make([]storage.Object, 0, len(r.Objects))
+	for _, o := range r.Objects {
+		objects = append(objects, o)
+	}
+	r.Unlock()
+
+	for _, o := range objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) Stats() (storage.Stats, error) {
+	if r == nil {
+		return storage.Stats{}, fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	s := storage.Stats{
+		Objects:        len(r.Objects),
+		Names:          len(r.Names),
+		Tags:           len(r.Tags),
+		Chunks:         len(r.Chunks),
+		CompressedSize: r.compressedSize,
+	}
+	for _, o := range r.Objects {
+		s.Size += o.Size()
+	}
+	return s, nil
+}
+
 func (r *repository) AddFile(file string, root string) error {
-	obj, err := storage.NewObject(file, root)
+	opts := storage.DefaultOptions()
+	opts.Hash = r.HashAlgorithm()
+	opts.Key = r.Key()
+	obj, err := storage.NewObject(file, root, opts)
 	if err != nil {
 		return err
 	}
+	defer obj.Close()
 	return r.Add(obj)
 }
 
@@ -95,17 +262,31 @@ func (r *repository) Add(o storage.Object) error {
 	r.Lock()
 	defer r.Unlock()
 
+	if r.wrapped != nil && r.key == nil {
+		return fmt.Errorf("repository is locked")
+	}
+
 	existing, ok := r.Objects[o.Hash()]
 	if !ok {
-		r.Objects[o.Hash()] = o
+		if err := r.addChunks(o); err != nil {
+			return err
+		}
+		stored := storage.NewStoredObject(storage.Manifest{
+			Hash:   o.Hash(),
+			Size:   o.Size(),
+			Chunks: o.Chunks(),
+		}, o.Entries(), o.Tags(), r.chunkData, r.key)
+		for kind, value := range o.Fingerprints() {
+			stored.SetFingerprint(kind, value)
+		}
+		r.Objects[o.Hash()] = stored
 		for _, name := range o.Names() {
-			r.Names[name] = map[uint64]storage.Object{o.Hash(): o}
+			addKeyToRepo(name, stored, r.Names)
 		}
 		for _, tag := range o.Tags() {
-			r.Tags[tag] = map[uint64]storage.Object{o.Hash(): o}
+			addKeyToRepo(tag, stored, r.Tags)
 		}
 		r.originalSize += uint64(o.Size())
-		r.compressedSize += uint64(o.CompressedSize())
 		return nil
 	}
 
@@ -115,22 +296,71 @@ func (r *repository) Add(o storage.Object) error {
 
 	r.originalSize += uint64(o.Size())
 
-	for _, name := range o.Names() {
-		existing.AddName(name)
-		addKeyToRepo(name, o, r.Names)
+	for _, e := range o.Entries() {
+		existing.AddEntry(e)
+		addKeyToRepo(e.Name, existing, r.Names)
 	}
 
 	for _, tag := range o.Tags() {
 		existing.AddTag(tag)
-		addKeyToRepo(tag, o, r.Tags)
+		addKeyToRepo(tag, existing, r.Tags)
 	}
 
+	known := existing.Fingerprints()
+	for kind, value := range o.Fingerprints() {
+		if _, ok := known[kind]; !ok {
+			existing.SetFingerprint(kind, value)
+		}
+	}
+
+	return nil
+}
+
+// addChunks copies the data of every chunk of o that is not yet stored
+func (r *repository) addChunks(o storage.Object) error {
+	chunks := o.Chunks()
+	for _, c := range chunks {
+		if existing, ok := r.Chunks[c.ID]; ok && existing.size != c.Size {
+			return fmt.Errorf("hash collision on chunk %s of %v", c.ID, o.Names())
+		}
+	}
+	for i, c := range chunks {
+		if existing, ok := r.Chunks[c.ID]; ok {
+			existing.refs++
+			continue
+		}
+		rc, err := o.OpenChunk(i)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		_, err = io.Copy(&b, rc)
+		if e := rc.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+		r.Chunks[c.ID] = &chunk{size: c.Size, data: b.Bytes(), refs: 1}
+		r.compressedSize += c.CompressedSize
+	}
 	return nil
 }
 
-func (r *repository) Remove(key uint64) {
+func (r *repository) chunkData(id storage.ID) (io.ReadCloser, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	c, ok := r.Chunks[id]
+	if !ok {
+		return nil, fmt.Errorf("missing chunk %s", id)
+	}
+	return io.NopCloser(bytes.NewReader(c.data)), nil
+}
+
+func (r *repository) Remove(key storage.ID) error {
 	if r == nil {
-		return
+		return fmt.Errorf("repository is nil")
 	}
 	r.Lock()
 	defer r.Unlock()
@@ -138,19 +368,140 @@ func (r *repository) Remove(key uint64) {
 	var ok bool
 	var obj storage.Object
 	if obj, ok = r.Objects[key]; !ok {
-		return
+		return fmt.Errorf("no object %s", key)
 	}
 	delete(r.Objects, key)
 	for _, name := range obj.Names() {
-		if m, ok := r.Names[name]; ok {
-			delete(m, key)
-		}
+		removeKeyFromRepo(name, key, r.Names)
 	}
 	for _, tag := range obj.Tags() {
-		if m, ok := r.Tags[tag]; ok {
-			delete(m, key)
+		removeKeyFromRepo(tag, key, r.Tags)
+	}
+	for _, c := range obj.Chunks() {
+		if stored, ok := r.Chunks[c.ID]; ok {
+			if stored.refs--; stored.refs <= 0 {
+				delete(r.Chunks, c.ID)
+				r.compressedSize -= c.CompressedSize
+			}
 		}
 	}
+	return nil
+}
+
+func (r *repository) SetCanonical(key storage.ID, name string) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	obj, ok := r.Objects[key]
+	if !ok {
+		return fmt.Errorf("no object %s", key)
+	}
+	if _, ok = r.Names[name][key]; !ok {
+		return fmt.Errorf("%q is not a name of %s", name, key)
+	}
+	obj.SetCanonical(name)
+	return nil
+}
+
+func (r *repository) AddSnapshot(s storage.Snapshot) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.History[s.ID]; ok {
+		return fmt.Errorf("snapshot %s already exists", s.ID)
+	}
+	files := map[string]storage.ID{}
+	for name, id := range s.Files {
+		files[name] = id
+	}
+	s.Files = files
+	s.Roots = append([]string{}, s.Roots...)
+	s.Tags = append([]string{}, s.Tags...)
+	r.History[s.ID] = s
+	return nil
+}
+
+func (r *repository) ForgetSnapshot(id string) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.History[id]; !ok {
+		return fmt.Errorf("no snapshot %s", id)
+	}
+	delete(r.History, id)
+	return nil
+}
+
+func (r *repository) Snapshots() ([]storage.Snapshot, error) {
+	if r == nil {
+		return nil, fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	snaps := []storage.Snapshot{}
+	for _, s := range r.History {
+		s.Files = nil
+		snaps = append(snaps, s)
+	}
+	storage.SortSnapshots(snaps)
+	return snaps, nil
+}
+
+func (r *repository) Snapshot(id string) (storage.Snapshot, error) {
+	if r == nil {
+		return storage.Snapshot{}, fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	s, ok := r.History[id]
+	if !ok {
+		return storage.Snapshot{}, fmt.Errorf("no snapshot %s", id)
+	}
+	files := map[string]storage.ID{}
+	for name, id := range s.Files {
+		files[name] = id
+	}
+	s.Files = files
+	return s, nil
+}
+
+func (r *repository) CachedID(name string, st storage.FileStat) (storage.ID, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	c, ok := r.Stat[name]
+	if !ok || c.stat != st {
+		return "", false
+	}
+	if _, ok = r.Objects[c.id]; !ok {
+		return "", false
+	}
+	return c.id, true
+}
+
+func (r *repository) CacheStat(name string, st storage.FileStat, id storage.ID) error {
+	if r == nil {
+		return fmt.Errorf("repository is nil")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	r.Stat[name] = cachedStat{stat: st, id: id}
+	return nil
 }
 
 func (r *repository) String() string {
@@ -165,7 +516,7 @@ func (r *repository) String() string {
 	return strings.Join(show, "\n")
 }
 
-func listKeys(m map[string]map[uint64]storage.Object) []string {
+func listKeys(m map[string]map[storage.ID]storage.Object) []string {
 	keys := []string{}
 	for key := range m {
 		keys = append(keys, key)
@@ -173,7 +524,7 @@ func listKeys(m map[string]map[uint64]storage.Object) []string {
 	return keys
 }
 
-func listObjects(key string, m map[string]map[uint64]storage.Object) []storage.Object {
+func listObjects(key string, m map[string]map[storage.ID]storage.Object) []storage.Object {
 	objects := []storage.Object{}
 	for _, obj := range m[key] {
 		objects = append(objects, obj)
@@ -181,11 +532,20 @@ func listObjects(key string, m map[string]map[uint64]storage.Object) []storage.O
 	return objects
 }
 
-func addKeyToRepo(key string, o storage.Object, repo map[string]map[uint64]storage.Object) {
+func addKeyToRepo(key string, o storage.Object, repo map[string]map[storage.ID]storage.Object) {
 	if p, ok := repo[key]; ok {
 		p[o.Hash()] = o
 	} else {
-		repo[key] = map[uint64]storage.Object{o.Hash(): o}
+		repo[key] = map[storage.ID]storage.Object{o.Hash(): o}
+	}
+}
+
+func removeKeyFromRepo(key string, id storage.ID, repo map[string]map[storage.ID]storage.Object) {
+	if p, ok := repo[key]; ok {
+		delete(p, id)
+		if len(p) == 0 {
+			delete(repo, key)
+		}
 	}
 }
 
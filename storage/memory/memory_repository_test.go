@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/johnweldon/consolidate/storage"
+	"github.com/johnweldon/consolidate/storage/factory"
+	"github.com/johnweldon/consolidate/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		r, err := factory.Registry.Open("memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+}
+
+// Records counts what is kept for id, repeats included
+func (r *repository) Records(kind string, id storage.ID) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	count := func(index map[string]map[storage.ID]storage.Object) (n int) {
+		for _, objects := range index {
+			if _, ok := objects[id]; ok {
+				n++
+			}
+		}
+		return n
+	}
+	switch kind {
+	case "names":
+		return count(r.Names), nil
+	case "tags":
+		return count(r.Tags), nil
+	case "entries":
+		if o, ok := r.Objects[id]; ok {
+			return len(o.Entries()), nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unknown record kind %q", kind)
+}
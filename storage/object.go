@@ -2,22 +2,26 @@ package storage
 
 import (
 	"bytes"
-	"compress/zlib"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"os"
 	"path"
+	"sort"
+	"strings"
 )
 
 // NewObject builds an Object from a file, and uses the root to build
-// tags out of leaf folders
-func NewObject(file string, root string) (Object, error) {
+// tags out of leaf folders. The content is identified and compressed as
+// described by opts, and split into content defined chunks that are
+// compressed independently. Files that are already compressed, and chunks
+// that do not shrink enough, are stored raw. With a Key, chunk data is
+// sealed and content ids are keyed. Any fingerprints in opts that apply
+// to the file are computed in a second pass over it.
+// The compressed data is spooled rather than held in memory, so the
+// returned Object must be closed once the repository has stored it
+func NewObject(file string, root string, opts Options) (Object, error) {
 	var err error
 	var fd *os.File
-	var b bytes.Buffer
-	var sz int64
 
 	root = path.Clean(root)
 	name := path.Clean(file)
@@ -30,66 +34,252 @@ func NewObject(file string, root string) (Object, error) {
 			fmt.Fprintf(os.Stderr, "error closing %q: %v\n", fname, e)
 		}
 	}(file)
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-	h := hashStrategy()
-	tw := io.MultiWriter(h, compressStrategy(&b))
-	if sz, err = io.Copy(tw, fd); err != nil {
+	h, err := opts.newHash()
+	if err != nil {
 		return nil, err
 	}
+	if _, ok := codecStrategies[opts.Compression]; !ok {
+		return nil, fmt.Errorf("unsupported codec %q", opts.Compression.String())
+	}
 
-	tags := map[string]interface{}{}
-	dir, elem := path.Split(suffix)
+	obj := &spooledObject{data: &spool{}, key: opts.Key}
+	var head []byte
+	var sz int64
+	cr := newChunker(fd)
 	for {
-		dir, elem = path.Split(dir)
-		if elem != "" {
-			tags[elem] = nil
-		}
-		if dir == "" {
+		chunk, err := cr.Next()
+		if err == io.EOF {
 			break
 		}
-		dir = dir[:len(dir)-1]
+		if err != nil {
+			_ = obj.Close()
+			return nil, err
+		}
+		if sz == 0 {
+			n := len(chunk)
+			if n > 512 {
+				n = 512
+			}
+			head = append(head, chunk[:n]...)
+			if isCompressed(head) {
+				opts.Compression = CodecNone
+			}
+		}
+		c, err := obj.addChunk(chunk, opts)
+		if err != nil {
+			_ = obj.Close()
+			return nil, err
+		}
+		_, _ = h.Write(chunk)
+		sz += int64(c.Size)
 	}
 
-	return &rawObject{
-		hash:   h.Sum64(),
-		names:  map[string]interface{}{name: nil},
-		tags:   tags,
-		size:   uint64(sz),
-		zzData: b.Bytes(),
-	}, nil
+	prints, err := fingerprints(fd, head, opts)
+	if err != nil {
+		_ = obj.Close()
+		return nil, err
+	}
+
+	tags := map[string]interface{}{}
+	for _, tag := range folderTags(suffix) {
+		tags[tag] = nil
+	}
+
+	obj.objectInfo = objectInfo{
+		hash:    NewID(h.Sum(nil)),
+		names:   map[string]interface{}{},
+		entries: map[string]Entry{},
+		tags:    tags,
+		size:    uint64(sz),
+
+		fingerprints: prints,
+	}
+	obj.AddEntry(NewEntry(name, root, fi))
+	return obj, nil
 }
 
 // Object is the basic interface for Repository objects
 type Object interface {
-	Hash() uint64
+	io.Closer
+	Hash() ID
 	Names() []string
+	// Entries holds the metadata recorded for each name
+	Entries() []Entry
 	Tags() []string
 	Size() uint64
 	CompressedSize() uint64
+	Chunks() []Chunk
 	AddName(name string)
+	AddEntry(e Entry)
 	AddTag(tag string)
+	// Canonical is the name chosen as the real copy of the content, or ""
+	// when none has been chosen
+	Canonical() string
+	// SetCanonical chooses one of the names as the real copy
+	SetCanonical(name string)
+	// Fingerprints holds the secondary hashes computed for the content
+	Fingerprints() map[Fingerprint]string
+	SetFingerprint(kind Fingerprint, value string)
+	// WriteData copies the content to dest; with decompress it is unsealed
+	// and inflated, otherwise the stored bytes are copied as they are
 	WriteData(dest io.Writer, decompress bool) error
-	RawData() []byte
+	// Open returns a reader over the stored (compressed) data
+	Open() (io.ReadCloser, error)
+	// OpenChunk returns a reader over the stored data of Chunks()[i]
+	OpenChunk(i int) (io.ReadCloser, error)
 }
 
-var hashStrategy = fnvHasher
-var compressStrategy = zlibCompress
+// Chunk is a content addressed piece of an Object
+type Chunk struct {
+	ID             ID
+	Size           uint64
+	CompressedSize uint64
+	Codec          Codec
+}
 
-type rawObject struct {
-	hash   uint64
-	names  map[string]interface{}
-	tags   map[string]interface{}
-	size   uint64
-	zzData []byte
+// Manifest is the stored description of an Object: its identity and the
+// ordered list of chunks that make up its content
+type Manifest struct {
+	Hash   ID
+	Size   uint64
+	Chunks []Chunk
 }
 
-func (o *rawObject) Hash() uint64           { return o.hash }
-func (o *rawObject) Names() []string        { return mapKeys(o.names) }
-func (o *rawObject) Tags() []string         { return mapKeys(o.tags) }
-func (o *rawObject) Size() uint64           { return o.size }
-func (o *rawObject) CompressedSize() uint64 { return uint64(len(o.zzData)) }
-func (o *rawObject) AddName(name string)    { o.names[name] = struct{}{} }
-func (o *rawObject) AddTag(tag string)      { o.tags[tag] = struct{}{} }
+// ChunkReader opens the stored data of a single chunk
+type ChunkReader func(id ID) (io.ReadCloser, error)
+
+// folderTags returns the folders of suffix, the part of a name below its
+// root, which are the tags the name gives its object
+func folderTags(suffix string) []string {
+	var tags []string
+	dir, elem := path.Split(suffix)
+	for {
+		dir, elem = path.Split(dir)
+		if elem != "" {
+			tags = append(tags, elem)
+		}
+		if dir == "" {
+			break
+		}
+		dir = dir[:len(dir)-1]
+	}
+	return tags
+}
+
+// NameTags returns the tags that name gives o, the folders between the
+// root it was added from and the file. A name recorded without its root
+// is taken to carry every tag of o
+func NameTags(o Object, name string) []string {
+	for _, e := range o.Entries() {
+		if e.Name != name {
+			continue
+		}
+		if root := strings.TrimSuffix(e.Root, "/"); e.Root != "" && strings.HasPrefix(name, root+"/") {
+			return folderTags(name[len(root):])
+		}
+		break
+	}
+	return o.Tags()
+}
+
+// NewStoredObject returns an Object described by m, named by entries,
+// whose chunk data is read through open and unsealed with key, if the
+// repository has one; repositories use it to hand out what they store
+func NewStoredObject(m Manifest, entries []Entry, tags []string, open ChunkReader, key *Key) Object {
+	o := &storedObject{
+		objectInfo: objectInfo{
+			hash:    m.Hash,
+			names:   map[string]interface{}{},
+			entries: map[string]Entry{},
+			tags:    map[string]interface{}{},
+			size:    m.Size,
+
+			fingerprints: map[Fingerprint]string{},
+		},
+		chunks: m.Chunks,
+		open:   open,
+		key:    key,
+	}
+	for _, e := range entries {
+		o.AddEntry(e)
+	}
+	for _, tag := range tags {
+		o.tags[tag] = nil
+	}
+	return o
+}
+
+type objectInfo struct {
+	hash      ID
+	names     map[string]interface{}
+	entries   map[string]Entry
+	tags      map[string]interface{}
+	size      uint64
+	canonical string
+
+	fingerprints map[Fingerprint]string
+}
+
+func (o *objectInfo) Hash() ID            { return o.hash }
+func (o *objectInfo) Names() []string     { return mapKeys(o.names) }
+func (o *objectInfo) Tags() []string      { return mapKeys(o.tags) }
+func (o *objectInfo) Size() uint64        { return o.size }
+func (o *objectInfo) AddName(name string) { o.names[name] = struct{}{} }
+func (o *objectInfo) AddTag(tag string)   { o.tags[tag] = struct{}{} }
+
+// Canonical returns the chosen name, as long as it is still a name of o
+func (o *objectInfo) Canonical() string {
+	if _, ok := o.names[o.canonical]; !ok {
+		return ""
+	}
+	return o.canonical
+}
+
+// SetCanonical chooses name, which must be one of the names of o
+func (o *objectInfo) SetCanonical(name string) {
+	if _, ok := o.names[name]; ok {
+		o.canonical = name
+	}
+}
+
+// Fingerprints returns a copy of the fingerprints of o
+func (o *objectInfo) Fingerprints() map[Fingerprint]string {
+	prints := map[Fingerprint]string{}
+	for kind, value := range o.fingerprints {
+		prints[kind] = value
+	}
+	return prints
+}
+
+func (o *objectInfo) SetFingerprint(kind Fingerprint, value string) {
+	o.fingerprints[kind] = value
+}
+
+// AddEntry records e, replacing any earlier metadata for the same name
+func (o *objectInfo) AddEntry(e Entry) {
+	o.names[e.Name] = struct{}{}
+	o.entries[e.Name] = e
+}
+
+// Entries returns the recorded metadata ordered by name; names added
+// without metadata have an Entry holding only the name
+func (o *objectInfo) Entries() []Entry {
+	entries := []Entry{}
+	for name := range o.names {
+		e, ok := o.entries[name]
+		if !ok {
+			e = Entry{Name: name, UID: -1, GID: -1}
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
 
 func mapKeys(m map[string]interface{}) []string {
 	keys := []string{}
@@ -99,28 +289,215 @@ func mapKeys(m map[string]interface{}) []string {
 	return keys
 }
 
-func (o *rawObject) WriteData(dest io.Writer, decompress bool) error {
+func compressedSize(chunks []Chunk) uint64 {
+	var sz uint64
+	for _, c := range chunks {
+		sz += c.CompressedSize
+	}
+	return sz
+}
+
+type spooledObject struct {
+	objectInfo
+	chunks  []Chunk
+	offsets []int64
+	data    *spool
+	key     *Key
+}
+
+// addChunk compresses p onto the end of the spool, or copies it there
+// as is if compressing would not save enough, sealing it if opts has a Key
+func (o *spooledObject) addChunk(p []byte, opts Options) (Chunk, error) {
+	h, err := opts.newHash()
+	if err != nil {
+		return Chunk{}, err
+	}
+	_, _ = h.Write(p)
+
+	c := Chunk{
+		ID:    NewID(h.Sum(nil)),
+		Size:  uint64(len(p)),
+		Codec: CodecNone,
+	}
+	data := p
+	if opts.Compression != CodecNone {
+		var b bytes.Buffer
+		zw, err := opts.Compression.NewWriter(&b)
+		if err != nil {
+			return Chunk{}, err
+		}
+		if _, err = zw.Write(p); err != nil {
+			return Chunk{}, err
+		}
+		if err = zw.Close(); err != nil {
+			return Chunk{}, err
+		}
+		if float64(b.Len()) <= float64(len(p))*(1-opts.MinSavings) {
+			c.Codec = opts.Compression
+			data = b.Bytes()
+		}
+	}
+
+	if opts.Key != nil {
+		if data, err = opts.Key.Seal(data); err != nil {
+			return Chunk{}, err
+		}
+	}
+
+	start := o.data.Size()
+	if _, err = o.data.Write(data); err != nil {
+		return Chunk{}, err
+	}
+	c.CompressedSize = uint64(len(data))
+	o.chunks = append(o.chunks, c)
+	o.offsets = append(o.offsets, start)
+	return c, nil
+}
+
+func (o *spooledObject) Chunks() []Chunk        { return o.chunks }
+func (o *spooledObject) CompressedSize() uint64 { return compressedSize(o.chunks) }
+func (o *spooledObject) Close() error           { return o.data.Close() }
+
+func (o *spooledObject) WriteData(dest io.Writer, decompress bool) error {
 	if o == nil {
 		return fmt.Errorf("nil object")
 	}
-	b := bytes.NewBuffer(o.zzData)
-	var r io.Reader = b
-	var err error
-	if decompress {
-		if r, err = zlib.NewReader(b); err != nil {
-			return err
-		}
+	return writeData(o, dest, decompress, o.key)
+}
+
+func (o *spooledObject) Open() (io.ReadCloser, error) {
+	if o == nil {
+		return nil, fmt.Errorf("nil object")
 	}
-	_, err = io.Copy(dest, r)
-	return err
+	return o.data.Section(0, o.data.Size())
+}
+
+func (o *spooledObject) OpenChunk(i int) (io.ReadCloser, error) {
+	if o == nil {
+		return nil, fmt.Errorf("nil object")
+	}
+	if i < 0 || i >= len(o.chunks) {
+		return nil, fmt.Errorf("chunk %d out of range", i)
+	}
+	return o.data.Section(o.offsets[i], int64(o.chunks[i].CompressedSize))
 }
 
-func (o *rawObject) RawData() []byte {
+type storedObject struct {
+	objectInfo
+	chunks []Chunk
+	open   ChunkReader
+	key    *Key
+}
+
+func (o *storedObject) Chunks() []Chunk        { return o.chunks }
+func (o *storedObject) CompressedSize() uint64 { return compressedSize(o.chunks) }
+func (o *storedObject) Close() error           { return nil }
+
+func (o *storedObject) WriteData(dest io.Writer, decompress bool) error {
 	if o == nil {
+		return fmt.Errorf("nil object")
+	}
+	return writeData(o, dest, decompress, o.key)
+}
+
+func (o *storedObject) Open() (io.ReadCloser, error) {
+	if o == nil {
+		return nil, fmt.Errorf("nil object")
+	}
+	return &chunkStream{o: o}, nil
+}
+
+func (o *storedObject) OpenChunk(i int) (io.ReadCloser, error) {
+	if o == nil {
+		return nil, fmt.Errorf("nil object")
+	}
+	if i < 0 || i >= len(o.chunks) {
+		return nil, fmt.Errorf("chunk %d out of range", i)
+	}
+	return o.open(o.chunks[i].ID)
+}
+
+// chunkStream reads the stored data of every chunk of an Object in order,
+// opening each one only when the previous one is exhausted
+type chunkStream struct {
+	o   Object
+	i   int
+	cur io.ReadCloser
+}
+
+func (s *chunkStream) Read(p []byte) (int, error) {
+	for {
+		if s.cur == nil {
+			if s.i >= len(s.o.Chunks()) {
+				return 0, io.EOF
+			}
+			rc, err := s.o.OpenChunk(s.i)
+			if err != nil {
+				return 0, err
+			}
+			s.cur = rc
+			s.i++
+		}
+		n, err := s.cur.Read(p)
+		if err == io.EOF {
+			err = s.cur.Close()
+			s.cur = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (s *chunkStream) Close() error {
+	if s.cur == nil {
 		return nil
 	}
-	return o.zzData
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
+
+// writeData copies the data of o to dest one chunk at a time, unsealing
+// and inflating each chunk if asked
+func writeData(o Object, dest io.Writer, decompress bool, key *Key) error {
+	for i := range o.Chunks() {
+		if err := writeChunk(o, i, dest, decompress, key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func fnvHasher() hash.Hash64             { return fnv.New64a() }
-func zlibCompress(w io.Writer) io.Writer { return zlib.NewWriter(w) }
+func writeChunk(o Object, i int, dest io.Writer, decompress bool, key *Key) error {
+	rc, err := o.OpenChunk(i)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if decompress && key != nil {
+		sealed, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		data, err := key.Open(sealed)
+		if err != nil {
+			return fmt.Errorf("chunk %s: %v", o.Chunks()[i].ID, err)
+		}
+		r = bytes.NewReader(data)
+	}
+	if decompress {
+		zr, err := o.Chunks()[i].Codec.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	_, err = io.Copy(dest, r)
+	return err
+}
@@ -0,0 +1,35 @@
+package storage
+
+import "hash"
+
+// Options control how NewObject identifies and stores content
+type Options struct {
+	Hash        HashAlgorithm
+	Compression Codec
+	// MinSavings is the fraction of its size a chunk must shrink by when
+	// compressed; chunks that shrink less are stored raw
+	MinSavings float64
+	// Key seals chunk data and keys content ids; nil stores plaintext
+	Key *Key
+	// Fingerprints are computed for every file they apply to
+	Fingerprints []Fingerprint
+}
+
+// DefaultOptions returns the Options used when nothing else is chosen
+func DefaultOptions() Options {
+	return Options{
+		Hash:        DefaultHash,
+		Compression: DefaultCodec,
+		MinSavings:  DefaultMinSavings,
+
+		Fingerprints: DefaultFingerprints,
+	}
+}
+
+// newHash returns the hash used for content ids, keyed when encrypting
+func (o Options) newHash() (hash.Hash, error) {
+	if o.Key != nil {
+		return o.Key.keyedHash(o.Hash)
+	}
+	return o.Hash.New()
+}
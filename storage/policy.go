@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Policy decides which snapshots to keep. A snapshot is kept when any
+// rule keeps it, and forgotten otherwise
+type Policy struct {
+	// Last keeps the n newest snapshots
+	Last int
+	// Daily, Weekly, Monthly and Yearly keep the newest snapshot of each
+	// of the n newest days, weeks, months and years that have one
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// Within keeps every snapshot taken within this long of the newest one
+	Within time.Duration
+	// Tags keeps every snapshot carrying any of these tags
+	Tags []string
+}
+
+// Empty reports whether the policy has no rules, and so would keep nothing
+func (p Policy) Empty() bool {
+	return p.Last == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0 &&
+		p.Yearly == 0 && p.Within == 0 && len(p.Tags) == 0
+}
+
+// Apply splits snaps into those the policy keeps and those it forgets,
+// each newest first, along with the reasons each kept snapshot is kept
+func (p Policy) Apply(snaps []Snapshot) (keep []Snapshot, forget []Snapshot, reasons map[string][]string) {
+	sorted := append([]Snapshot{}, snaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+
+	reasons = map[string][]string{}
+	keepBy := func(name string, n int, bucket func(Snapshot) string) {
+		last := ""
+		for _, s := range sorted {
+			if n <= 0 {
+				return
+			}
+			if b := bucket(s); b != last {
+				reasons[s.ID] = append(reasons[s.ID], name)
+				last = b
+				n--
+			}
+		}
+	}
+
+	keepBy("last", p.Last, func(s Snapshot) string { return s.ID })
+	keepBy("daily", p.Daily, func(s Snapshot) string { return s.Time.Format("2006-01-02") })
+	keepBy("weekly", p.Weekly, func(s Snapshot) string {
+		y, w := s.Time.ISOWeek()
+		return fmt.Sprintf("%04d-%02d", y, w)
+	})
+	keepBy("monthly", p.Monthly, func(s Snapshot) string { return s.Time.Format("2006-01") })
+	keepBy("yearly", p.Yearly, func(s Snapshot) string { return s.Time.Format("2006") })
+
+	if p.Within > 0 && len(sorted) > 0 {
+		since := sorted[0].Time.Add(-p.Within)
+		for _, s := range sorted {
+			if !s.Time.Before(since) {
+				reasons[s.ID] = append(reasons[s.ID], "within")
+			}
+		}
+	}
+	for _, s := range sorted {
+		for _, tag := range p.Tags {
+			if s.HasTag(tag) {
+				reasons[s.ID] = append(reasons[s.ID], "tag "+tag)
+			}
+		}
+	}
+
+	for _, s := range sorted {
+		if len(reasons[s.ID]) > 0 {
+			keep = append(keep, s)
+		} else {
+			forget = append(forget, s)
+		}
+	}
+	return keep, forget, reasons
+}
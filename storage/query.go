@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query selects names of objects. It is evaluated for each name of an
+// object, so name terms test that name and tag terms the folders it lies
+// in, while size terms test the object it belongs to
+type Query interface {
+	Match(o Object, name string) bool
+	String() string
+}
+
+// And matches when both sides match
+type And struct{ Left, Right Query }
+
+// Or matches when either side matches
+type Or struct{ Left, Right Query }
+
+// Not matches when Q does not
+type Not struct{ Q Query }
+
+// TagTerm matches names that gave their object Tag
+type TagTerm struct{ Tag string }
+
+// NameTerm matches names against a path.Match pattern; a pattern without a
+// slash is matched against the last element of the name only
+type NameTerm struct{ Pattern string }
+
+// SizeTerm compares the size of an object with Size using Op, one of
+// <, <=, =, >= and >
+type SizeTerm struct {
+	Op   string
+	Size uint64
+}
+
+func (q And) Match(o Object, name string) bool {
+	return q.Left.Match(o, name) && q.Right.Match(o, name)
+}
+
+func (q Or) Match(o Object, name string) bool {
+	return q.Left.Match(o, name) || q.Right.Match(o, name)
+}
+
+func (q Not) Match(o Object, name string) bool {
+	return !q.Q.Match(o, name)
+}
+
+func (q TagTerm) Match(o Object, name string) bool {
+	for _, tag := range NameTags(o, name) {
+		if tag == q.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (q NameTerm) Match(_ Object, name string) bool {
+	if !strings.Contains(q.Pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(q.Pattern, name)
+	return ok
+}
+
+func (q SizeTerm) Match(o Object, _ string) bool {
+	switch size := o.Size(); q.Op {
+	case "<":
+		return size < q.Size
+	case "<=":
+		return size <= q.Size
+	case "=":
+		return size == q.Size
+	case ">=":
+		return size >= q.Size
+	default:
+		return size > q.Size
+	}
+}
+
+func (q And) String() string      { return "(" + q.Left.String() + " AND " + q.Right.String() + ")" }
+func (q Or) String() string       { return "(" + q.Left.String() + " OR " + q.Right.String() + ")" }
+func (q Not) String() string      { return "NOT " + q.Q.String() }
+func (q TagTerm) String() string  { return "tag:" + strconv.Quote(q.Tag) }
+func (q NameTerm) String() string { return "name:" + strconv.Quote(q.Pattern) }
+func (q SizeTerm) String() string { return "size" + q.Op + strconv.FormatUint(q.Size, 10) }
+
+// MatchAny reports whether q matches any name of o
+func MatchAny(q Query, o Object) bool {
+	for _, name := range o.Names() {
+		if q.Match(o, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseQuery reads a query such as
+//
+//	tag:photos AND (tag:2019 OR tag:2020) AND NOT tag:thumbs AND size>1MB AND name:*.jpg
+//
+// Terms next to each other are joined with AND, and values holding spaces
+// or parentheses can be quoted, as in name:"IMG (1).jpg"
+func ParseQuery(s string) (Query, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEnd {
+		return nil, fmt.Errorf("query: unexpected %q at %d", t.text, t.pos)
+	}
+	return q, nil
+}
+
+type tokenKind int
+
+const (
+	tokEnd tokenKind = iota
+	tokOpen
+	tokClose
+	tokWord
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	quoted bool
+	pos    int
+}
+
+// lexQuery splits a query into parentheses and words; quotes may appear
+// anywhere in a word and are removed
+func lexQuery(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokOpen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokClose, text: ")", pos: i})
+			i++
+		default:
+			t := token{kind: tokWord, pos: i}
+			var b strings.Builder
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && s[i] != '(' && s[i] != ')' {
+				if s[i] != '"' {
+					b.WriteByte(s[i])
+					i++
+					continue
+				}
+				t.quoted = true
+				end := i + 1
+				for end < len(s) && s[end] != '"' {
+					if s[end] == '\\' && end+1 < len(s) {
+						end++
+					}
+					end++
+				}
+				if end >= len(s) {
+					return nil, fmt.Errorf("query: unterminated quote at %d", i)
+				}
+				v, err := strconv.Unquote(s[i : end+1])
+				if err != nil {
+					return nil, fmt.Errorf("query: bad quoted value at %d", i)
+				}
+				b.WriteString(v)
+				i = end + 1
+			}
+			t.text = b.String()
+			tokens = append(tokens, t)
+		}
+	}
+	return append(tokens, token{kind: tokEnd, pos: len(s)}), nil
+}
+
+type queryParser struct {
+	tokens []token
+	i      int
+}
+
+func (p *queryParser) peek() token { return p.tokens[p.i] }
+func (p *queryParser) next() token { t := p.tokens[p.i]; p.i++; return t }
+
+func (p *queryParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokWord && !t.quoted && strings.EqualFold(t.text, word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) or() (Query, error) {
+	q, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		q = Or{q, right}
+	}
+	return q, nil
+}
+
+func (p *queryParser) and() (Query, error) {
+	q, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !p.keyword("AND") {
+			t := p.peek()
+			if t.kind == tokEnd || t.kind == tokClose ||
+				t.kind == tokWord && !t.quoted && strings.EqualFold(t.text, "OR") {
+				return q, nil
+			}
+		}
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		q = And{q, right}
+	}
+}
+
+func (p *queryParser) not() (Query, error) {
+	if p.keyword("NOT") {
+		q, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return Not{q}, nil
+	}
+	return p.primary()
+}
+
+func (p *queryParser) primary() (Query, error) {
+	t := p.next()
+	switch t.kind {
+	case tokOpen:
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokClose {
+			return nil, fmt.Errorf("query: expected ) at %d", c.pos)
+		}
+		return q, nil
+	case tokWord:
+		return parseTerm(t)
+	case tokEnd:
+		return nil, fmt.Errorf("query: unexpected end")
+	}
+	return nil, fmt.Errorf("query: unexpected %q at %d", t.text, t.pos)
+}
+
+func parseTerm(t token) (Query, error) {
+	switch {
+	case strings.HasPrefix(t.text, "tag:"):
+		if tag := t.text[len("tag:"):]; tag != "" {
+			return TagTerm{tag}, nil
+		}
+	case strings.HasPrefix(t.text, "name:"):
+		pattern := t.text[len("name:"):]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("query: bad pattern %q at %d", pattern, t.pos)
+		}
+		if pattern != "" {
+			return NameTerm{pattern}, nil
+		}
+	case strings.HasPrefix(t.text, "size"):
+		rest := t.text[len("size"):]
+		for _, op := range []string{"<=", ">=", "<", ">", "="} {
+			if strings.HasPrefix(rest, op) {
+				if rest == op {
+					return nil, fmt.Errorf("query: size%s needs a size at %d", op, t.pos)
+				}
+				size, err := ParseSize(rest[len(op):])
+				if err != nil {
+					return nil, fmt.Errorf("query: %v at %d", err, t.pos)
+				}
+				return SizeTerm{op, size}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("query: bad term %q at %d", t.text, t.pos)
+}
+
+// ParseSize reads a byte count such as "512", "64k", "1MB" or "2GiB";
+// units are powers of 1024
+func ParseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimRight(strings.ToLower(s), "bi")
+	shift := uint(0)
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+		if shift > 0 {
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return uint64(v * float64(uint64(1)<<shift)), nil
+}
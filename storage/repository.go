@@ -2,7 +2,71 @@ package storage
 
 // Repository is the overall storage unit
 type Repository interface {
+	Add(o Object) error
 	AddFile(file string, root string) error
 	AllNames() []string
 	AllTags() []string
+	// Object returns the object with id, or nil
+	Object(id ID) Object
+	// Has reports whether an object with id is stored
+	Has(id ID) bool
+	ObjectsByName(name string) []Object
+	ObjectsByTag(tag string) []Object
+	// Find returns every object with a name that q matches
+	Find(q Query) ([]Object, error)
+	// Iterate calls fn with every object, one at a time, and stops at the
+	// first error fn returns
+	Iterate(fn func(Object) error) error
+	// Stats summarizes what the repository holds
+	Stats() (Stats, error)
+	// AddSnapshot records an ingest run
+	AddSnapshot(s Snapshot) error
+	// Snapshots lists every snapshot, oldest first, without their files
+	Snapshots() ([]Snapshot, error)
+	// Snapshot returns a snapshot together with its files
+	Snapshot(id string) (Snapshot, error)
+	// ForgetSnapshot drops a snapshot; the objects it refers to stay
+	ForgetSnapshot(id string) error
+	// Remove deletes an object and every chunk no other object uses
+	Remove(id ID) error
+	// SetCanonical records which name of an object is its real copy
+	SetCanonical(id ID, name string) error
+	HashAlgorithm() HashAlgorithm
+}
+
+// Stats are the totals of a repository
+type Stats struct {
+	Objects int
+	Names   int
+	Tags    int
+	Chunks  int
+	// Size is the total size of the distinct objects
+	Size uint64
+	// CompressedSize is what their chunks take up once stored
+	CompressedSize uint64
+}
+
+// Encryptable is implemented by repositories that can seal what they store
+type Encryptable interface {
+	// Encrypt turns on encryption for an empty repository, optionally
+	// sealing names and tags as well as data
+	Encrypt(passphrase []byte, names bool) error
+	// Unseal recovers the master key of an encrypted repository
+	Unseal(passphrase []byte) error
+	// Encrypted reports whether the repository was created with a key
+	Encrypted() bool
+	// Key is the unlocked master key, or nil
+	Key() *Key
+}
+
+// StatCache is implemented by repositories that remember the stat each name
+// had when its file was last read, so that a file unchanged since need not
+// be read again
+type StatCache interface {
+	// CachedID returns the content id recorded for name if the file still
+	// has stat st and an object with that id is still stored
+	CachedID(name string, st FileStat) (ID, bool)
+	// CacheStat records that the file of name had stat st when it was read
+	// and held the content id
+	CacheStat(name string, st FileStat, id ID) error
 }
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
+
+// simHashMaxSize bounds the files SimHash reads; larger ones are rarely
+// documents anyone edits by hand
+const simHashMaxSize = 32 << 20
+
+// simHash fingerprints a text by its overlapping three word shingles: each
+// shingle votes on every bit with its own hash, so texts that share most
+// shingles end up with fingerprints that differ in few bits
+func simHash(r io.ReadSeeker, opts Options) (string, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if size > simHashMaxSize {
+		return "", fmt.Errorf("too large for a similarity hash")
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h, err := opts.newHash()
+	if err != nil {
+		return "", err
+	}
+
+	var votes [64]int
+	var sum []byte
+	vote := func(feature []byte) {
+		h.Reset()
+		_, _ = h.Write(feature)
+		sum = h.Sum(sum[:0])
+		v := binary.BigEndian.Uint64(sum[:8])
+		for i := range votes {
+			if v&(1<<uint(i)) != 0 {
+				votes[i]++
+			} else {
+				votes[i]--
+			}
+		}
+	}
+
+	const width = 3
+	var window [][]byte
+	var words int
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanWords)
+	for scanner.Scan() {
+		window = append(window, bytes.ToLower(scanner.Bytes()))
+		if len(window) > width {
+			window = window[1:]
+		}
+		if words++; words >= width {
+			vote(bytes.Join(window, []byte{' '}))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+	switch {
+	case words == 0:
+		return "", fmt.Errorf("no words")
+	case words < width:
+		vote(bytes.Join(window, []byte{' '}))
+	}
+
+	var fp uint64
+	for i, n := range votes {
+		if n > 0 {
+			fp |= 1 << uint(i)
+		}
+	}
+	return fmt.Sprintf("%016x", fp), nil
+}
+
+// scanWords splits text into runs of letters, digits and underscores
+func scanWords(data []byte, atEOF bool) (int, []byte, error) {
+	start := 0
+	for start < len(data) {
+		if !atEOF && !utf8.FullRune(data[start:]) {
+			return start, nil, nil
+		}
+		r, w := utf8.DecodeRune(data[start:])
+		if isWordRune(r) {
+			break
+		}
+		start += w
+	}
+	for i := start; i < len(data); {
+		if !atEOF && !utf8.FullRune(data[i:]) {
+			return start, nil, nil
+		}
+		r, w := utf8.DecodeRune(data[i:])
+		if !isWordRune(r) {
+			return i + w, data[start:i], nil
+		}
+		i += w
+	}
+	if atEOF && start < len(data) {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isText reports whether head looks like the start of a UTF-8 text
+func isText(head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+	for _, b := range head {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\v' && b != 0x1b {
+			return false
+		}
+	}
+	// the head may end part way through a character
+	for i := 0; i < utf8.UTFMax-1 && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Snapshot records one ingest run: when and where it ran, the roots it
+// read and the content every path under them had at the time
+type Snapshot struct {
+	ID    string
+	Time  time.Time
+	Host  string
+	Roots []string
+	Tags  []string
+	// Files maps each path seen to its content; repositories leave it
+	// empty when listing snapshots
+	Files map[string]ID
+}
+
+// NewSnapshot starts a snapshot of roots taken now on this host
+func NewSnapshot(roots []string) (Snapshot, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return Snapshot{}, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	s := Snapshot{
+		ID:    hex.EncodeToString(b),
+		Time:  time.Now(),
+		Host:  host,
+		Files: map[string]ID{},
+	}
+	for _, root := range roots {
+		s.Roots = append(s.Roots, path.Clean(root))
+	}
+	return s, nil
+}
+
+// Names returns the paths in the snapshot in order
+func (s Snapshot) Names() []string {
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasTag reports whether the snapshot carries tag
+func (s Snapshot) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SortSnapshots orders snapshots oldest first
+func SortSnapshots(snaps []Snapshot) {
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+}
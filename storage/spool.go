@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spoolThreshold is the number of bytes a spool keeps in memory before it
+// moves its contents to a temporary file
+var spoolThreshold = 4 << 20
+
+// spool is a write-once buffer that stays in memory while it is small and
+// spills to a temporary file once it grows past spoolThreshold
+type spool struct {
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.mem.Len()+len(p) > spoolThreshold {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *spool) spill() error {
+	f, err := os.CreateTemp("", "consolidate-spool-")
+	if err != nil {
+		return err
+	}
+	if _, err = s.mem.WriteTo(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+// Size is the number of bytes written to the spool
+func (s *spool) Size() int64 { return s.size }
+
+// Open returns a reader over everything written so far
+func (s *spool) Open() (io.ReadCloser, error) {
+	if s.file == nil {
+		return io.NopCloser(bytes.NewReader(s.mem.Bytes())), nil
+	}
+	return io.NopCloser(io.NewSectionReader(s.file, 0, s.size)), nil
+}
+
+// Section returns a reader over n bytes starting at off
+func (s *spool) Section(off, n int64) (io.ReadCloser, error) {
+	if s.file == nil {
+		return io.NopCloser(bytes.NewReader(s.mem.Bytes()[off : off+n])), nil
+	}
+	return io.NopCloser(io.NewSectionReader(s.file, off, n)), nil
+}
+
+// Close releases the memory or temporary file held by the spool
+func (s *spool) Close() error {
+	s.mem = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	if e := os.Remove(name); err == nil {
+		err = e
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,82 @@
+package sqlite
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/johnweldon/consolidate/storage"
+	"github.com/johnweldon/consolidate/storage/factory"
+)
+
+// openDir keeps a repository in a directory: the index in index.db and the
+// data of each chunk in a file of its own under chunks, named by its id
+func openDir(opts factory.Options) (storage.Repository, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("dir backend needs a directory, e.g. dir:///mnt/store")
+	}
+	chunks := filepath.Join(opts.Path, "chunks")
+	if err := os.MkdirAll(chunks, 0700); err != nil {
+		return nil, err
+	}
+	return &repository{
+		path:    filepath.Join(opts.Path, "index.db"),
+		chunks:  dirChunks(chunks),
+		newHash: opts.Hash,
+	}, nil
+}
+
+// dirChunks is a directory holding chunk data as files, spread over
+// subdirectories by the first two characters of the id. Files are written
+// before the transaction that records them commits and removed after the
+// one that drops them, so a failure leaves at worst an unused file
+type dirChunks string
+
+func (d dirChunks) path(id string) string {
+	return filepath.Join(string(d), id[:2], id)
+}
+
+// write stores a chunk through a temporary file, so that a chunk file is
+// either whole or missing
+func (d dirChunks) write(id string, r io.Reader) error {
+	file := d.path(id)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, r); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d dirChunks) open(id string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("missing chunk file %s", id)
+	}
+	return f, err
+}
+
+// remove deletes the files of chunks, ignoring those already gone
+func (d dirChunks) remove(chunks []string) error {
+	for _, id := range chunks {
+		if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
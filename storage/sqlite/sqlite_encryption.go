@@ -0,0 +1,155 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// Encrypt seals chunk data, and names and tags if asked, with a new master
+// key wrapped by passphrase. Only an empty repository can be encrypted
+func (r *repository) Encrypt(passphrase []byte, names bool) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.wrapped != nil {
+		return fmt.Errorf("repository is already encrypted")
+	}
+	if r.hash == storage.FNV64a {
+		return fmt.Errorf("encryption needs a cryptographic hash, not %s", r.hash)
+	}
+	var count int
+	if err := r.db.QueryRow(`select count(*) from objects`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("only an empty repository can be encrypted")
+	}
+
+	w, k, err := storage.NewWrappedKey(passphrase)
+	if err != nil {
+		return err
+	}
+	sealNames := "0"
+	if names {
+		sealNames = "1"
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, value := range map[string]string{"key": w.String(), "seal_names": sealNames} {
+		if _, err = tx.Exec(`insert or replace into meta (key, value) values (?, ?)`, key, value); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	r.wrapped, r.key, r.sealNames = w, k, names
+	return nil
+}
+
+// Unseal recovers the master key of an encrypted repository
+func (r *repository) Unseal(passphrase []byte) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if r.wrapped == nil {
+		return fmt.Errorf("repository is not encrypted")
+	}
+	k, err := r.wrapped.Unwrap(passphrase)
+	if err != nil {
+		return err
+	}
+	r.key = k
+	return nil
+}
+
+func (r *repository) Encrypted() bool {
+	return r.error() == nil && r.wrapped != nil
+}
+
+func (r *repository) Key() *storage.Key {
+	if err := r.error(); err != nil {
+		return nil
+	}
+	return r.key
+}
+
+// loadKey reads the wrapped master key, if any, from the meta table
+func (r *repository) loadKey() error {
+	var wrapped, sealNames string
+	err := r.db.QueryRow(`select value from meta where key = 'key'`).Scan(&wrapped)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.wrapped, err = storage.ParseWrappedKey(wrapped); err != nil {
+		return err
+	}
+	err = r.db.QueryRow(`select value from meta where key = 'seal_names'`).Scan(&sealNames)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	r.sealNames = sealNames == "1"
+	return nil
+}
+
+// locked reports an error if the repository is encrypted but not unsealed
+func (r *repository) locked() error {
+	if r.wrapped != nil && r.key == nil {
+		return fmt.Errorf("repository is locked")
+	}
+	return nil
+}
+
+// sealName encrypts a name or tag if the repository seals names
+func (r *repository) sealName(name string) string {
+	if !r.sealNames || r.key == nil {
+		return name
+	}
+	return r.key.SealName(name)
+}
+
+// openName decrypts a name read from the database if names are sealed
+func (r *repository) openName(name string) (string, error) {
+	if !r.sealNames {
+		return name, nil
+	}
+	if err := r.locked(); err != nil {
+		return "", err
+	}
+	return r.key.OpenName(name)
+}
+
+// openNames decrypts names read from the database and puts them back in
+// order, since sealed names do not sort like their plain text
+func (r *repository) openNames(names []string) ([]string, error) {
+	if !r.sealNames {
+		return names, nil
+	}
+	if err := r.locked(); err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		plain, err := r.key.OpenName(name)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = plain
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// Find narrows the objects down in SQL and checks what is left against q,
+// since a GLOB is looser than the path.Match of a name term
+func (r *repository) Find(q storage.Query) ([]storage.Object, error) {
+	if err := r.error(); err != nil {
+		return nil, err
+	}
+
+	where, args, _ := r.queryWhere(q)
+	candidates, err := r.objectsWhere(`select distinct n.id from names n join objects o on o.id = n.id where `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	found := []storage.Object{}
+	for _, o := range candidates {
+		if storage.MatchAny(q, o) {
+			found = append(found, o)
+		}
+	}
+	return found, nil
+}
+
+// queryWhere translates q into a condition on a row n of names joined with
+// its object o. The condition selects at least every row q matches, and
+// exactly those when exact is set; NOT only applies to exact conditions so
+// that the result never shrinks below what q matches
+func (r *repository) queryWhere(q storage.Query) (string, []interface{}, bool) {
+	switch q := q.(type) {
+	case storage.And:
+		l, largs, lexact := r.queryWhere(q.Left)
+		rt, rargs, rexact := r.queryWhere(q.Right)
+		return "(" + l + " and " + rt + ")", append(largs, rargs...), lexact && rexact
+	case storage.Or:
+		l, largs, lexact := r.queryWhere(q.Left)
+		rt, rargs, rexact := r.queryWhere(q.Right)
+		return "(" + l + " or " + rt + ")", append(largs, rargs...), lexact && rexact
+	case storage.Not:
+		cond, args, exact := r.queryWhere(q.Q)
+		if !exact {
+			return "1", nil, false
+		}
+		return "not " + cond, args, true
+	case storage.TagTerm:
+		// tags are kept for the object, not for each of its names
+		return `exists (select 1 from tags t where t.id = n.id and t.tag = ?)`, []interface{}{r.sealName(q.Tag)}, false
+	case storage.NameTerm:
+		// sealed names cannot be matched in SQL, and GLOB has no escapes
+		if r.sealNames || strings.Contains(q.Pattern, `\`) {
+			return "1", nil, false
+		}
+		if strings.Contains(q.Pattern, "/") {
+			return `n.name glob ?`, []interface{}{q.Pattern}, false
+		}
+		return `(n.name glob ? or n.name glob ?)`, []interface{}{q.Pattern, "*/" + q.Pattern}, false
+	case storage.SizeTerm:
+		switch q.Op {
+		case "<", "<=", "=", ">=", ">":
+			return fmt.Sprintf("o.size %s ?", q.Op), []interface{}{int64(q.Size)}, true
+		}
+	}
+	return "1", nil, false
+}
@@ -3,7 +3,10 @@ package sqlite
 import (
 	"database/sql"
 	"fmt"
+	"io"
+	"os"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -12,14 +15,21 @@ import (
 )
 
 func init() {
-	factory.Registry.Add("sqlite", newRepository)
+	factory.Registry.Add("sqlite", openSQLite)
+	factory.Registry.Add("dir", openDir)
 }
 
-func newRepository() storage.Repository {
-	path := ".consolidate.db"
-	return &repository{
-		path: path,
+// openSQLite keeps a repository in one database file, .consolidate.db in
+// the working directory unless opts name another
+func openSQLite(opts factory.Options) (storage.Repository, error) {
+	path := opts.Path
+	if path == "" {
+		path = ".consolidate.db"
 	}
+	return &repository{
+		path:    path,
+		newHash: opts.Hash,
+	}, nil
 }
 
 type repository struct {
@@ -28,7 +38,24 @@ type repository struct {
 	err error
 
 	path string
+	hash storage.HashAlgorithm
 	db   *sql.DB
+	// newHash is the hash a new database is created with
+	newHash storage.HashAlgorithm
+	// chunks holds chunk data as files when set, instead of the segments
+	// table
+	chunks dirChunks
+
+	wrapped   *storage.WrappedKey
+	key       *storage.Key
+	sealNames bool
+}
+
+func (r *repository) HashAlgorithm() storage.HashAlgorithm {
+	if err := r.error(); err != nil {
+		return ""
+	}
+	return r.hash
 }
 
 func (r *repository) AllNames() []string {
@@ -54,6 +81,9 @@ func (r *repository) AllNames() []string {
 		names = append(names, name)
 	}
 
+	if names, err = r.openNames(names); err != nil {
+		return nil
+	}
 	return names
 }
 
@@ -80,18 +110,403 @@ func (r *repository) AllTags() []string {
 		tags = append(tags, tag)
 	}
 
+	if tags, err = r.openNames(tags); err != nil {
+		return nil
+	}
 	return tags
 }
 
+func (r *repository) Object(key storage.ID) storage.Object {
+	if err := r.error(); err != nil {
+		return nil
+	}
+	if err := r.locked(); err != nil {
+		return nil
+	}
+
+	obj, err := r.load(key.String())
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		r.err = err
+		return nil
+	}
+	return obj
+}
+
+func (r *repository) Has(key storage.ID) bool {
+	if err := r.error(); err != nil {
+		return false
+	}
+
+	var one int
+	err := r.db.QueryRow(`select 1 from objects where id = ?`, key.String()).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		r.err = err
+		return false
+	}
+	return true
+}
+
+func (r *repository) ObjectsByName(name string) []storage.Object {
+	if err := r.error(); err != nil {
+		return nil
+	}
+
+	objects, err := r.objectsWhere(`select distinct id from names where name = ?`, r.sealName(name))
+	if err != nil {
+		r.err = err
+		return nil
+	}
+	return objects
+}
+
+func (r *repository) ObjectsByTag(tag string) []storage.Object {
+	if err := r.error(); err != nil {
+		return nil
+	}
+
+	objects, err := r.objectsWhere(`select distinct id from tags where tag = ?`, r.sealName(tag))
+	if err != nil {
+		r.err = err
+		return nil
+	}
+	return objects
+}
+
+// Iterate lists the ids first and loads each object only when fn is ready
+// for it, so fn may use the repository
+func (r *repository) Iterate(fn func(storage.Object) error) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.locked(); err != nil {
+		return err
+	}
+
+	ids, err := r.plainStrings(`select id from objects order by id`)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		obj, err := r.load(id)
+		if err == sql.ErrNoRows {
+			continue // removed by fn
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) Stats() (storage.Stats, error) {
+	var s storage.Stats
+	if err := r.error(); err != nil {
+		return s, err
+	}
+
+	queries := []struct {
+		query string
+		dest  []interface{}
+	}{
+		{`select count(*), coalesce(sum(size), 0) from objects`, []interface{}{&s.Objects, &s.Size}},
+		{`select count(*), coalesce(sum(csize), 0) from chunks`, []interface{}{&s.Chunks, &s.CompressedSize}},
+		{`select count(distinct name) from names`, []interface{}{&s.Names}},
+		{`select count(distinct tag) from tags`, []interface{}{&s.Tags}},
+	}
+	for _, q := range queries {
+		if err := r.db.QueryRow(q.query).Scan(q.dest...); err != nil {
+			return storage.Stats{}, err
+		}
+	}
+	return s, nil
+}
+
+// objectsWhere loads every object whose id is returned by query
+func (r *repository) objectsWhere(query string, args ...interface{}) ([]storage.Object, error) {
+	if err := r.locked(); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	var id string
+	for rows.Next() {
+		if err = rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	objects := []storage.Object{}
+	for _, id := range ids {
+		obj, err := r.load(id)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// load reads the manifest, entries and tags of an object
+func (r *repository) load(id string) (storage.Object, error) {
+	m := storage.Manifest{Hash: storage.ID(id)}
+	if err := r.db.QueryRow(`select size from objects where id = ?`, id).Scan(&m.Size); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(`select c.id, c.size, c.csize, c.codec from object_chunks oc join chunks c on c.id = oc.chunk where oc.id = ? order by oc.seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c storage.Chunk
+		var chunkID, codec string
+		if err = rows.Scan(&chunkID, &c.Size, &c.CompressedSize, &codec); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		c.ID, c.Codec = storage.ID(chunkID), storage.Codec(codec)
+		m.Chunks = append(m.Chunks, c)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	entries, err := r.entries(id)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := r.strings(`select tag from tags where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	obj := storage.NewStoredObject(m, entries, tags, r.chunkData, r.key)
+	if err = r.fingerprints(id, obj); err != nil {
+		return nil, err
+	}
+
+	var canonical string
+	err = r.db.QueryRow(`select name from canonical where id = ?`, id).Scan(&canonical)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		if canonical, err = r.openName(canonical); err != nil {
+			return nil, err
+		}
+		obj.SetCanonical(canonical)
+	}
+	return obj, nil
+}
+
+// fingerprints reads the fingerprints of an object into obj
+func (r *repository) fingerprints(id string, obj storage.Object) error {
+	rows, err := r.db.Query(`select kind, value from fingerprints where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, value string
+		if err = rows.Scan(&kind, &value); err != nil {
+			return err
+		}
+		if value, err = r.openName(value); err != nil {
+			return err
+		}
+		obj.SetFingerprint(storage.Fingerprint(kind), value)
+	}
+	return rows.Err()
+}
+
+// entries reads the name entries of an object; names recorded before
+// entries existed get an entry holding only the name
+func (r *repository) entries(id string) ([]storage.Entry, error) {
+	rows, err := r.db.Query(`select n.name, e.root, e.mode, e.mtime, e.uid, e.gid from names n left join entries e on e.id = n.id and e.name = n.name where n.id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	entries := []storage.Entry{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var root sql.NullString
+		var mode, mtime, uid, gid sql.NullInt64
+		if err = rows.Scan(&name, &root, &mode, &mtime, &uid, &gid); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		e := storage.Entry{Name: name, UID: -1, GID: -1}
+		if root.Valid {
+			e.Root = root.String
+			e.Mode = os.FileMode(mode.Int64)
+			e.ModTime = time.Unix(0, mtime.Int64)
+			e.UID, e.GID = int(uid.Int64), int(gid.Int64)
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		if entries[i].Xattrs, err = r.xattrs(id, e.Name); err != nil {
+			return nil, err
+		}
+		if entries[i].Name, err = r.openName(e.Name); err != nil {
+			return nil, err
+		}
+		if e.Root != "" {
+			if entries[i].Root, err = r.openName(e.Root); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (r *repository) xattrs(id string, name string) (map[string][]byte, error) {
+	rows, err := r.db.Query(`select attr, value from xattrs where id = ? and name = ?`, id, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attrs map[string][]byte
+	for rows.Next() {
+		var attr string
+		var value []byte
+		if err = rows.Scan(&attr, &value); err != nil {
+			return nil, err
+		}
+		if attr, err = r.openName(attr); err != nil {
+			return nil, err
+		}
+		plain, err := r.openName(string(value))
+		if err != nil {
+			return nil, err
+		}
+		if attrs == nil {
+			attrs = map[string][]byte{}
+		}
+		attrs[attr] = []byte(plain)
+	}
+	return attrs, rows.Err()
+}
+
+// strings returns the single text column of every row of query, unsealed
+func (r *repository) strings(query string, args ...interface{}) ([]string, error) {
+	values, err := r.plainStrings(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return r.openNames(values)
+}
+
+// plainStrings returns the single text column of every row of query
+func (r *repository) plainStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	var value string
+	for rows.Next() {
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// chunkData streams the stored data of a chunk one segment at a time, or
+// from its file
+func (r *repository) chunkData(id storage.ID) (io.ReadCloser, error) {
+	var count int
+	if err := r.db.QueryRow(`select count(*) from chunks where id = ?`, id.String()).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("missing chunk %s", id)
+	}
+	if r.chunks != "" {
+		return r.chunks.open(id.String())
+	}
+	return &segmentReader{db: r.db, id: id.String()}, nil
+}
+
+// segmentReader reads the segments of a chunk in order
+type segmentReader struct {
+	db  *sql.DB
+	id  string
+	seq int
+	buf []byte
+	eof bool
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		err := s.db.QueryRow(`select data from segments where id = ? and seq = ?`, s.id, s.seq).Scan(&s.buf)
+		if err == sql.ErrNoRows {
+			s.eof = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.seq++
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *segmentReader) Close() error {
+	s.buf, s.eof = nil, true
+	return nil
+}
+
 func (r *repository) AddFile(file string, root string) error {
 	if err := r.error(); err != nil {
 		return err
 	}
 
-	obj, err := storage.NewObject(file, root)
+	opts := storage.DefaultOptions()
+	opts.Hash = r.hash
+	opts.Key = r.key
+	obj, err := storage.NewObject(file, root, opts)
 	if err != nil {
 		return err
 	}
+	defer obj.Close()
 	return r.Add(obj)
 }
 
@@ -99,60 +514,301 @@ func (r *repository) Add(o storage.Object) error {
 	if err := r.error(); err != nil {
 		return err
 	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
 
-	stmt, err := r.db.Prepare(`insert or ignore into objects (id, size, data) values (?, ?, ?)`)
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.locked(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
 	if err != nil {
 		r.err = err
 		return err
 	}
+	if err = addObject(tx, o, r.chunks, r.sealName); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
 
+// Remove deletes an object, its names and tags, and every chunk that no
+// other object uses
+func (r *repository) Remove(key storage.ID) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
 	r.Lock()
 	defer r.Unlock()
 
-	_, err = stmt.Exec(int64(o.Hash()), o.Size(), o.RawData())
+	tx, err := r.db.Begin()
 	if err != nil {
-		r.err = err
 		return err
 	}
+	orphans, err := removeObject(tx, key.String())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if r.chunks != "" {
+		return r.chunks.remove(orphans)
+	}
+	return nil
+}
+
+// SetCanonical records name as the real copy of an object
+func (r *repository) SetCanonical(key storage.ID, name string) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
 
-	stmt, err = r.db.Prepare(`insert or ignore into names (id, name) values (?, ?)`)
+	if err := r.locked(); err != nil {
+		return err
+	}
+	sealed := r.sealName(name)
+	var found int
+	if err := r.db.QueryRow(`select count(*) from names where id = ? and name = ?`, key.String(), sealed).Scan(&found); err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("%q is not a name of %s", name, key)
+	}
+	_, err := r.db.Exec(`insert or replace into canonical (id, name) values (?, ?)`, key.String(), sealed)
+	return err
+}
+
+// removeObject deletes an object and returns the chunks it leaves unused
+func removeObject(tx *sql.Tx, id string) ([]string, error) {
+	res, err := tx.Exec(`delete from objects where id = ?`, id)
 	if err != nil {
-		r.err = err
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, fmt.Errorf("no object %s", id)
+	}
+
+	rows, err := tx.Query(`select distinct chunk from object_chunks where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	chunks := []string{}
+	var chunk string
+	for rows.Next() {
+		if err = rows.Scan(&chunk); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, table := range []string{"object_chunks", "names", "entries", "xattrs", "tags", "canonical", "fingerprints", "stat_cache"} {
+		if _, err = tx.Exec(`delete from `+table+` where id = ?`, id); err != nil {
+			return nil, err
+		}
+	}
+	orphans := []string{}
+	for _, chunk := range chunks {
+		var used int
+		if err = tx.QueryRow(`select count(*) from object_chunks where chunk = ?`, chunk).Scan(&used); err != nil {
+			return nil, err
+		}
+		if used > 0 {
+			continue
+		}
+		if _, err = tx.Exec(`delete from chunks where id = ?`, chunk); err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec(`delete from segments where id = ?`, chunk); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, chunk)
+	}
+	return orphans, nil
+}
+
+// segmentSize bounds how much chunk data is held in memory while it is
+// copied into the segments table
+const segmentSize = 1 << 20
+
+// addObject stores o, passing its names and tags through seal
+func addObject(tx *sql.Tx, o storage.Object, chunks dirChunks, seal func(string) string) error {
+	id := o.Hash().String()
+
+	var size uint64
+	err := tx.QueryRow(`select size from objects where id = ?`, id).Scan(&size)
+	switch {
+	case err == sql.ErrNoRows:
+		if err = addChunks(tx, o, chunks); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`insert into objects (id, size, csize) values (?, ?, ?)`, id, o.Size(), o.CompressedSize()); err != nil {
+			return err
+		}
+	case err != nil:
 		return err
+	case size != o.Size():
+		return fmt.Errorf("hash collision on %s: %v", o.Hash(), o.Names())
 	}
 
+	stmt, err := tx.Prepare(`insert or ignore into names (id, name) values (?, ?)`)
+	if err != nil {
+		return err
+	}
 	for _, name := range o.Names() {
-		_, err = stmt.Exec(int64(o.Hash()), name)
-		if err != nil {
-			r.err = err
+		if _, err = stmt.Exec(id, seal(name)); err != nil {
+			_ = stmt.Close()
 			return err
 		}
 	}
 	if err = stmt.Close(); err != nil {
-		r.err = err
 		return err
 	}
 
-	stmt, err = r.db.Prepare(`insert or ignore into tags (id, tag) values (?, ?)`)
-	if err != nil {
-		r.err = err
+	if err = addEntries(tx, o, seal); err != nil {
 		return err
 	}
 
+	stmt, err = tx.Prepare(`insert or ignore into tags (id, tag) values (?, ?)`)
+	if err != nil {
+		return err
+	}
 	for _, tag := range o.Tags() {
-		_, err = stmt.Exec(int64(o.Hash()), tag)
-		if err != nil {
-			r.err = err
+		if _, err = stmt.Exec(id, seal(tag)); err != nil {
+			_ = stmt.Close()
 			return err
 		}
 	}
 	if err = stmt.Close(); err != nil {
-		r.err = err
 		return err
 	}
+
+	for kind, value := range o.Fingerprints() {
+		if _, err = tx.Exec(`insert or ignore into fingerprints (id, kind, value) values (?, ?, ?)`, id, kind.String(), seal(value)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// addEntries records the metadata of every name of o, replacing what was
+// recorded for the same name before
+func addEntries(tx *sql.Tx, o storage.Object, seal func(string) string) error {
+	id := o.Hash().String()
+
+	for _, e := range o.Entries() {
+		name := seal(e.Name)
+		if _, err := tx.Exec(`insert or replace into entries (id, name, root, mode, mtime, uid, gid) values (?, ?, ?, ?, ?, ?, ?)`,
+			id, name, seal(e.Root), uint32(e.Mode), e.ModTime.UnixNano(), e.UID, e.GID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`delete from xattrs where id = ? and name = ?`, id, name); err != nil {
+			return err
+		}
+		for attr, value := range e.Xattrs {
+			if _, err := tx.Exec(`insert into xattrs (id, name, attr, value) values (?, ?, ?, ?)`,
+				id, name, seal(attr), []byte(seal(string(value)))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addChunks records the chunk list of o and stores the data of every
+// chunk that is not already present
+func addChunks(tx *sql.Tx, o storage.Object, chunks dirChunks) error {
+	id := o.Hash().String()
+
+	for seq, c := range o.Chunks() {
+		var size uint64
+		err := tx.QueryRow(`select size from chunks where id = ?`, c.ID.String()).Scan(&size)
+		switch {
+		case err == sql.ErrNoRows:
+			if err = addChunkData(tx, o, seq, chunks); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case size != c.Size:
+			return fmt.Errorf("hash collision on chunk %s of %v", c.ID, o.Names())
+		}
+		if _, err = tx.Exec(`insert into object_chunks (id, seq, chunk) values (?, ?, ?)`, id, seq, c.ID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addChunkData streams the stored data of chunk i of o into the segments
+// table, or into a file of its own when chunks is set
+func addChunkData(tx *sql.Tx, o storage.Object, i int, chunks dirChunks) error {
+	c := o.Chunks()[i]
+
+	rc, err := o.OpenChunk(i)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if chunks != "" {
+		if err = chunks.write(c.ID.String(), rc); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`insert into chunks (id, size, csize, codec) values (?, ?, ?, ?)`, c.ID.String(), c.Size, c.CompressedSize, c.Codec.String())
+		return err
+	}
+
+	stmt, err := tx.Prepare(`insert into segments (id, seq, data) values (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	buf := make([]byte, segmentSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			if _, e := stmt.Exec(c.ID.String(), seq, buf[:n]); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`insert into chunks (id, size, csize, codec) values (?, ?, ?, ?)`, c.ID.String(), c.Size, c.CompressedSize, c.Codec.String())
+	return err
+}
+
 func (r *repository) init() {
 	if r.err != nil {
 		return
@@ -164,18 +820,44 @@ func (r *repository) init() {
 	}
 	r.db = db
 
-	stmts := []string{
-		`create table if not exists objects (id integer not null primary key, size integer, data blob)`,
-		`create table if not exists names (id integer not null, name text)`,
-		`create table if not exists tags (id integer not null, tag text)`,
+	if _, err = r.db.Exec(`create table if not exists meta (key text not null primary key, value text)`); err != nil {
+		r.err = err
+		return
 	}
-
-	for _, stmt := range stmts {
-		if _, err = r.db.Exec(stmt); err != nil {
+	if r.newHash != "" {
+		// createLegacyTables keeps this unless the database predates meta
+		if _, err = r.db.Exec(`insert or ignore into meta (key, value) select 'hash', ? where not exists (select 1 from sqlite_master where type = 'table' and name = 'objects')`, r.newHash.String()); err != nil {
 			r.err = err
 			return
 		}
 	}
+	if err = r.migrate(); err != nil {
+		r.err = err
+		return
+	}
+
+	var hash string
+	if err = r.db.QueryRow(`select value from meta where key = 'hash'`).Scan(&hash); err != nil {
+		r.err = err
+		return
+	}
+	if r.hash, err = storage.ParseHashAlgorithm(hash); err != nil {
+		r.err = err
+		return
+	}
+	if err = r.loadKey(); err != nil {
+		r.err = err
+		return
+	}
+}
+
+// readOnly reports an error for any change to a repository whose content
+// ids can collide, before it is made
+func (r *repository) readOnly() error {
+	if !r.hash.Writable() {
+		return fmt.Errorf("repository uses %s content ids, which can collide, so it is read only; restore its files and add them to a new repository", r.hash)
+	}
+	return nil
 }
 
 func (r *repository) error() error {
@@ -188,3 +870,227 @@ func (r *repository) error() error {
 	}
 	return r.err
 }
+
+// migrations upgrade the schema one version at a time; the index of a
+// migration is the schema version it upgrades from
+var migrations = []func(tx *sql.Tx) error{
+	createLegacyTables,
+	textObjectIDs,
+	segmentedData,
+	objectChunks,
+	chunkCodecs,
+	nameEntries,
+	snapshots,
+	legacySnapshot,
+	canonicalNames,
+	objectFingerprints,
+	statCache,
+	uniqueNames,
+}
+
+func (r *repository) migrate() error {
+	version, err := r.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = migrations[version](tx); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migrating schema from version %d: %v", version, err)
+		}
+		if _, err = tx.Exec(`insert or replace into meta (key, value) values ('version', ?)`, version+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) schemaVersion() (int, error) {
+	var version int
+	err := r.db.QueryRow(`select value from meta where key = 'version'`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// createLegacyTables is the original schema; databases written before the
+// meta table existed are at this version and hashed with FNV-64a
+func createLegacyTables(tx *sql.Tx) error {
+	var legacy int
+	if err := tx.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = 'objects'`).Scan(&legacy); err != nil {
+		return err
+	}
+	hash := storage.DefaultHash
+	if legacy > 0 {
+		hash = storage.FNV64a
+	}
+	if _, err := tx.Exec(`insert or ignore into meta (key, value) values ('hash', ?)`, hash.String()); err != nil {
+		return err
+	}
+
+	return execAll(tx,
+		`create table if not exists objects (id integer not null primary key, size integer, data blob)`,
+		`create table if not exists names (id integer not null, name text)`,
+		`create table if not exists tags (id integer not null, tag text)`,
+	)
+}
+
+// textObjectIDs widens the object id from a 64 bit integer to a hex
+// encoded digest; legacy ids keep their FNV-64a value
+func textObjectIDs(tx *sql.Tx) error {
+	return execAll(tx,
+		`alter table objects rename to objects_v0`,
+		`alter table names rename to names_v0`,
+		`alter table tags rename to tags_v0`,
+		`create table objects (id text not null primary key, size integer, data blob)`,
+		`create table names (id text not null, name text)`,
+		`create table tags (id text not null, tag text)`,
+		`insert into objects (id, size, data) select printf('%016x', id), size, data from objects_v0`,
+		`insert into names (id, name) select printf('%016x', id), name from names_v0`,
+		`insert into tags (id, tag) select printf('%016x', id), tag from tags_v0`,
+		`drop table objects_v0`,
+		`drop table names_v0`,
+		`drop table tags_v0`,
+	)
+}
+
+// segmentedData moves object data out of the objects table into fixed size
+// segments so that no single row has to hold a whole file
+func segmentedData(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table segments (id text not null, seq integer not null, data blob, primary key (id, seq))`,
+		`insert into segments (id, seq, data) select id, 0, data from objects where data is not null`,
+		`alter table objects rename to objects_v2`,
+		`create table objects (id text not null primary key, size integer, csize integer)`,
+		`insert into objects (id, size, csize) select id, size, coalesce(length(data), 0) from objects_v2`,
+		`drop table objects_v2`,
+	)
+}
+
+// objectChunks splits objects into content defined chunks; existing
+// objects become a single chunk that shares the id of the object
+func objectChunks(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table chunks (id text not null primary key, size integer, csize integer)`,
+		`create table object_chunks (id text not null, seq integer not null, chunk text not null, primary key (id, seq))`,
+		`insert into chunks (id, size, csize) select id, size, csize from objects where csize > 0`,
+		`insert into object_chunks (id, seq, chunk) select id, 0, id from objects where csize > 0`,
+	)
+}
+
+// chunkCodecs records the codec of each chunk; everything stored before
+// codecs were selectable is zlib
+func chunkCodecs(tx *sql.Tx) error {
+	return execAll(tx,
+		`alter table chunks add column codec text not null default 'zlib'`,
+	)
+}
+
+// nameEntries records file metadata for each name of an object
+func nameEntries(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table entries (id text not null, name text not null, root text, mode integer, mtime integer, uid integer, gid integer, primary key (id, name))`,
+		`create table xattrs (id text not null, name text not null, attr text not null, value blob, primary key (id, name, attr))`,
+	)
+}
+
+// snapshots records each ingest run and the content every path had
+func snapshots(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table snapshots (id text not null primary key, time integer, host text)`,
+		`create table snapshot_roots (snapshot text not null, root text not null)`,
+		`create table snapshot_files (snapshot text not null, name text not null, id text not null, primary key (snapshot, name))`,
+	)
+}
+
+// legacySnapshot adds snapshot tags, and gathers every name recorded
+// before snapshots existed into snapshots tagged "legacy", so that pruning
+// unreferenced objects does not remove them. A name that had several
+// contents is spread over several legacy snapshots
+func legacySnapshot(tx *sql.Tx) error {
+	if err := execAll(tx,
+		`create table snapshot_tags (snapshot text not null, tag text not null)`,
+	); err != nil {
+		return err
+	}
+
+	const remaining = `from names n where not exists (select 1 from snapshot_files f where f.name = n.name and f.id = n.id)`
+	for i := 1; ; i++ {
+		var count int
+		if err := tx.QueryRow(`select count(*) ` + remaining).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		id := "legacy"
+		if i > 1 {
+			id = fmt.Sprintf("legacy-%d", i)
+		}
+		stmts := []string{
+			`insert into snapshots (id, time, host) values (?, cast(strftime('%s', 'now') as integer) * 1000000000, '')`,
+			`insert into snapshot_tags (snapshot, tag) values (?, 'legacy')`,
+			`insert or ignore into snapshot_files (snapshot, name, id) select ?, n.name, n.id ` + remaining,
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt, id); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// canonicalNames records the name chosen as the real copy of an object
+func canonicalNames(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table canonical (id text not null primary key, name text not null)`,
+	)
+}
+
+// objectFingerprints records secondary hashes of object content
+func objectFingerprints(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table fingerprints (id text not null, kind text not null, value text not null, primary key (id, kind))`,
+		`create index fingerprints_kind on fingerprints (kind)`,
+	)
+}
+
+// statCache remembers the stat each name had when its file was last read
+// and the content it held, so that unchanged files are not read again
+func statCache(tx *sql.Tx) error {
+	return execAll(tx,
+		`create table stat_cache (name text not null primary key, dev integer, ino integer, size integer, mtime integer, ctime integer, id text not null)`,
+		`create index stat_cache_id on stat_cache (id)`,
+	)
+}
+
+// uniqueNames drops the repeated name and tag rows that earlier adds of
+// the same file left behind and keeps new ones out, so that insert or
+// ignore ignores them
+func uniqueNames(tx *sql.Tx) error {
+	return execAll(tx,
+		`delete from names where rowid not in (select min(rowid) from names group by id, name)`,
+		`delete from tags where rowid not in (select min(rowid) from tags group by id, tag)`,
+		`create unique index names_id_name on names (id, name)`,
+		`create unique index tags_id_tag on tags (id, tag)`,
+	)
+}
+
+func execAll(tx *sql.Tx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnweldon/consolidate/storage"
+	"github.com/johnweldon/consolidate/storage/factory"
+	"github.com/johnweldon/consolidate/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	backends := map[string]func(dir string) string{
+		"sqlite": func(dir string) string { return "sqlite://" + filepath.ToSlash(filepath.Join(dir, "test.db")) },
+		"dir":    func(dir string) string { return "dir://" + filepath.ToSlash(dir) },
+	}
+	for name, dsn := range backends {
+		dsn := dsn
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.Repository {
+				r, err := factory.Registry.Open(dsn(t.TempDir()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return r
+			})
+		})
+	}
+}
+
+// Records counts the rows kept for id, repeats included
+func (r *repository) Records(kind string, id storage.ID) (int, error) {
+	tables := map[string]string{"names": "names", "tags": "tags", "entries": "entries"}
+	table, ok := tables[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown record kind %q", kind)
+	}
+	if err := r.error(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := r.db.QueryRow(`select count(*) from `+table+` where id = ?`, id.String()).Scan(&n)
+	return n, err
+}
+
+func TestUniqueNamesMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	old := &repository{path: path}
+	if err := old.error(); err != nil {
+		t.Fatal(err)
+	}
+	// put the database back as adds before the migration left it
+	for _, stmt := range []string{
+		`drop index names_id_name`,
+		`drop index tags_id_tag`,
+		`insert into names (id, name) values ('a', 'x'), ('a', 'x'), ('a', 'y'), ('b', 'x')`,
+		`insert into tags (id, tag) values ('a', 't'), ('a', 't'), ('b', 't')`,
+	} {
+		if _, err := old.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := old.db.Exec(`update meta set value = ? where key = 'version'`, len(migrations)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &repository{path: path}
+	if err := r.error(); err != nil {
+		t.Fatal(err)
+	}
+	for table, want := range map[string]int{"names": 3, "tags": 2} {
+		var n int
+		if err := r.db.QueryRow(`select count(*) from ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s: %d row(s) after the migration, want %d", table, n, want)
+		}
+	}
+	if _, err := r.db.Exec(`insert or ignore into names (id, name) values ('a', 'x')`); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := r.db.QueryRow(`select count(*) from names where id = 'a' and name = 'x'`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("names: %d row(s) for a repeated insert, %v", n, err)
+	}
+}
+
+func TestLegacyReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the schema and a row as written before content ids were
+	// cryptographic
+	for _, stmt := range []string{
+		`create table objects (id integer not null primary key, size integer, data blob)`,
+		`create table names (id integer not null, name text)`,
+		`create table tags (id integer not null, tag text)`,
+		`insert into objects (id, size, data) values (1234, 5, null)`,
+		`insert into names (id, name) values (1234, 'a.txt')`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := factory.Registry.Open("sqlite://" + filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.HashAlgorithm(); got != storage.FNV64a {
+		t.Fatalf("HashAlgorithm: got %s, want %s", got, storage.FNV64a)
+	}
+	if !r.Has("00000000000004d2") || len(r.ObjectsByName("a.txt")) != 1 {
+		t.Errorf("legacy object not found")
+	}
+
+	file := filepath.Join(t.TempDir(), "b.txt")
+	if err = os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.AddFile(file, filepath.Dir(file)); err == nil {
+		t.Error("AddFile: stored new content under fnv64a ids")
+	}
+	if err = r.Remove("00000000000004d2"); err == nil {
+		t.Error("Remove: changed a read only repository")
+	}
+	if err = r.AddSnapshot(storage.Snapshot{ID: "s"}); err == nil {
+		t.Error("AddSnapshot: changed a read only repository")
+	}
+}
@@ -0,0 +1,185 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func (r *repository) AddSnapshot(s storage.Snapshot) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.locked(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = addSnapshot(tx, s, r.sealName); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func addSnapshot(tx *sql.Tx, s storage.Snapshot, seal func(string) string) error {
+	if _, err := tx.Exec(`insert into snapshots (id, time, host) values (?, ?, ?)`, s.ID, s.Time.UnixNano(), seal(s.Host)); err != nil {
+		return err
+	}
+	for _, root := range s.Roots {
+		if _, err := tx.Exec(`insert into snapshot_roots (snapshot, root) values (?, ?)`, s.ID, seal(root)); err != nil {
+			return err
+		}
+	}
+	for _, tag := range s.Tags {
+		if _, err := tx.Exec(`insert into snapshot_tags (snapshot, tag) values (?, ?)`, s.ID, tag); err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare(`insert into snapshot_files (snapshot, name, id) values (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for name, id := range s.Files {
+		if _, err = stmt.Exec(s.ID, seal(name), id.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repository) Snapshots() ([]storage.Snapshot, error) {
+	if err := r.error(); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(`select id from snapshots order by time`)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	var id string
+	for rows.Next() {
+		if err = rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	snaps := []storage.Snapshot{}
+	for _, id := range ids {
+		s, err := r.snapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, s)
+	}
+	return snaps, nil
+}
+
+func (r *repository) Snapshot(id string) (storage.Snapshot, error) {
+	if err := r.error(); err != nil {
+		return storage.Snapshot{}, err
+	}
+
+	s, err := r.snapshot(id)
+	if err == sql.ErrNoRows {
+		return s, fmt.Errorf("no snapshot %s", id)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	rows, err := r.db.Query(`select name, id from snapshot_files where snapshot = ?`, id)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	s.Files = map[string]storage.ID{}
+	for rows.Next() {
+		var name, obj string
+		if err = rows.Scan(&name, &obj); err != nil {
+			return s, err
+		}
+		if name, err = r.openName(name); err != nil {
+			return s, err
+		}
+		s.Files[name] = storage.ID(obj)
+	}
+	return s, rows.Err()
+}
+
+// snapshot reads everything but the files of a snapshot
+func (r *repository) snapshot(id string) (storage.Snapshot, error) {
+	s := storage.Snapshot{ID: id}
+	var nanos int64
+	var host string
+	if err := r.db.QueryRow(`select time, host from snapshots where id = ?`, id).Scan(&nanos, &host); err != nil {
+		return s, err
+	}
+	s.Time = time.Unix(0, nanos)
+
+	var err error
+	if host != "" {
+		if s.Host, err = r.openName(host); err != nil {
+			return s, err
+		}
+	}
+	if s.Roots, err = r.strings(`select root from snapshot_roots where snapshot = ?`, id); err != nil {
+		return s, err
+	}
+	s.Tags, err = r.plainStrings(`select tag from snapshot_tags where snapshot = ? order by tag`, id)
+	return s, err
+}
+
+func (r *repository) ForgetSnapshot(id string) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`delete from snapshots where id = ?`, id)
+	if err == nil {
+		var n int64
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = fmt.Errorf("no snapshot %s", id)
+		}
+	}
+	for _, table := range []string{"snapshot_roots", "snapshot_tags", "snapshot_files"} {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(`delete from `+table+` where snapshot = ?`, id)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,49 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// CachedID looks name up in the stat cache; an entry whose object has
+// since been removed is a miss
+func (r *repository) CachedID(name string, st storage.FileStat) (storage.ID, bool) {
+	if err := r.error(); err != nil {
+		return "", false
+	}
+
+	var id string
+	err := r.db.QueryRow(`select s.id from stat_cache s join objects o on o.id = s.id
+		where s.name = ? and s.dev = ? and s.ino = ? and s.size = ? and s.mtime = ? and s.ctime = ?`,
+		r.sealName(name), int64(st.Device), int64(st.Inode), st.Size, st.ModTime, st.ChangeTime).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		r.err = err
+		return "", false
+	}
+	return storage.ID(id), true
+}
+
+// CacheStat records the stat and content of name, replacing what an
+// earlier read recorded
+func (r *repository) CacheStat(name string, st storage.FileStat, id storage.ID) error {
+	if err := r.error(); err != nil {
+		return err
+	}
+	if err := r.readOnly(); err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.locked(); err != nil {
+		return err
+	}
+
+	_, err := r.db.Exec(`insert or replace into stat_cache (name, dev, ino, size, mtime, ctime, id) values (?, ?, ?, ?, ?, ?, ?)`,
+		r.sealName(name), int64(st.Device), int64(st.Inode), st.Size, st.ModTime, st.ChangeTime, id.String())
+	return err
+}
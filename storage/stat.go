@@ -0,0 +1,23 @@
+package storage
+
+import "os"
+
+// FileStat is the part of the stat of a file that changes whenever its
+// content may have. Device and inode tell a file replaced under the same
+// name apart, and the change time catches writes that restore the
+// modification time
+type FileStat struct {
+	Device     uint64
+	Inode      uint64
+	Size       int64
+	ModTime    int64 // unix nanoseconds
+	ChangeTime int64 // unix nanoseconds
+}
+
+// NewFileStat captures the stat of fi; where the system does not report a
+// device, inode or change time they stay zero
+func NewFileStat(fi os.FileInfo) FileStat {
+	st := FileStat{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	fillStat(&st, fi)
+	return st
+}
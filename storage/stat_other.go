@@ -0,0 +1,7 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+func fillStat(st *FileStat, fi os.FileInfo) {}
@@ -0,0 +1,16 @@
+//go:build unix && !darwin && !freebsd && !netbsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func fillStat(st *FileStat, fi os.FileInfo) {
+	if s, ok := fi.Sys().(*syscall.Stat_t); ok {
+		st.Device = uint64(s.Dev)
+		st.Inode = uint64(s.Ino)
+		st.ChangeTime = s.Ctim.Nano()
+	}
+}
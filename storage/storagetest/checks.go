@@ -0,0 +1,555 @@
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// checks run in order, each against a new repository
+var checks = []struct {
+	name string
+	run  func(t *testing.T, r storage.Repository, f *fixture)
+}{
+	{"Empty", checkEmpty},
+	{"AddAndLookup", checkAddAndLookup},
+	{"RepeatedAdd", checkRepeatedAdd},
+	{"SameContent", checkSameContent},
+	{"Collision", checkCollision},
+	{"Remove", checkRemove},
+	{"ConcurrentAdds", checkConcurrentAdds},
+	{"LargeObject", checkLargeObject},
+	{"Iterate", checkIterate},
+	{"Find", checkFind},
+	{"FindTagOfName", checkFindTagOfName},
+	{"Canonical", checkCanonical},
+	{"Snapshots", checkSnapshots},
+	{"StatCache", checkStatCache},
+	{"Errors", checkErrors},
+}
+
+// missing is an id no check ever stores
+var missing = storage.ID("0000000000000000000000000000000000000000000000000000000000000000")
+
+func checkEmpty(t *testing.T, r storage.Repository, _ *fixture) {
+	if r.Has(missing) {
+		t.Error("Has: true for an empty repository")
+	}
+	if o := r.Object(missing); o != nil {
+		t.Errorf("Object: got %s from an empty repository", o.Hash())
+	}
+	if names := r.AllNames(); len(names) != 0 {
+		t.Errorf("AllNames: got %v", names)
+	}
+	if tags := r.AllTags(); len(tags) != 0 {
+		t.Errorf("AllTags: got %v", tags)
+	}
+	if s, err := r.Stats(); err != nil || s != (storage.Stats{}) {
+		t.Errorf("Stats: got %+v, %v", s, err)
+	}
+	calls := 0
+	if err := r.Iterate(func(storage.Object) error { calls++; return nil }); err != nil || calls != 0 {
+		t.Errorf("Iterate: %d call(s), %v", calls, err)
+	}
+	if snaps, err := r.Snapshots(); err != nil || len(snaps) != 0 {
+		t.Errorf("Snapshots: got %d, %v", len(snaps), err)
+	}
+}
+
+func checkAddAndLookup(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(1, 100<<10)
+	o := f.add(r, "photos/2019/a.jpg", data)
+	id := o.Hash()
+
+	if !r.Has(id) {
+		t.Fatal("Has: false after Add")
+	}
+	got := r.Object(id)
+	if got == nil {
+		t.Fatal("Object: nil after Add")
+	}
+	if got.Hash() != id || got.Size() != uint64(len(data)) {
+		t.Errorf("Object: got %s size %d, want %s size %d", got.Hash(), got.Size(), id, len(data))
+	}
+	if !equal(got.Names(), o.Names()) {
+		t.Errorf("Names: got %v, want %v", got.Names(), o.Names())
+	}
+	if !equal(got.Tags(), o.Tags()) || !contains(got.Tags(), "photos") || !contains(got.Tags(), "2019") {
+		t.Errorf("Tags: got %v, want %v", got.Tags(), o.Tags())
+	}
+	if string(readAll(t, got)) != string(data) {
+		t.Error("WriteData: content differs from what was added")
+	}
+
+	name := o.Names()[0]
+	if found := ids(r.ObjectsByName(name)); !equal(found, []string{id.String()}) {
+		t.Errorf("ObjectsByName(%s): got %v", name, found)
+	}
+	if found := ids(r.ObjectsByTag("photos")); !equal(found, []string{id.String()}) {
+		t.Errorf("ObjectsByTag(photos): got %v", found)
+	}
+	if found := r.ObjectsByName("no/such/name"); len(found) != 0 {
+		t.Errorf("ObjectsByName of an unknown name: got %v", ids(found))
+	}
+	if !contains(r.AllNames(), name) {
+		t.Errorf("AllNames: %v lacks %s", r.AllNames(), name)
+	}
+	if !contains(r.AllTags(), "photos") {
+		t.Errorf("AllTags: %v lacks photos", r.AllTags())
+	}
+
+	s, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Objects != 1 || s.Names != 1 || s.Tags != 2 || s.Size != uint64(len(data)) || s.Chunks == 0 {
+		t.Errorf("Stats: got %+v", s)
+	}
+}
+
+func checkRepeatedAdd(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(2, 10<<10)
+	o := f.add(r, "docs/a.txt", data)
+	before, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Add(o); err != nil {
+		t.Fatalf("Add of the same object: %v", err)
+	}
+	if err = r.Add(f.object("docs/a.txt", data)); err != nil {
+		t.Fatalf("Add of the same file: %v", err)
+	}
+
+	after, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("Stats: %+v after adding again, %+v before", after, before)
+	}
+	got := r.Object(o.Hash())
+	if len(got.Names()) != 1 || len(got.Entries()) != 1 || len(got.Tags()) != 1 {
+		t.Errorf("repeated adds duplicated names %v, entries %d or tags %v", got.Names(), len(got.Entries()), got.Tags())
+	}
+	if found := r.ObjectsByName(o.Names()[0]); len(found) != 1 {
+		t.Errorf("ObjectsByName: got %d object(s)", len(found))
+	}
+	if rec, ok := r.(Records); ok {
+		for _, kind := range []string{"names", "tags", "entries"} {
+			if n, err := rec.Records(kind, o.Hash()); err != nil || n != 1 {
+				t.Errorf("Records(%s): %d after three adds, %v", kind, n, err)
+			}
+		}
+	}
+}
+
+func checkSameContent(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(3, 300<<10)
+	a := f.add(r, "one/a.bin", data)
+	single, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := f.add(r, "two/b.bin", data)
+	if a.Hash() != b.Hash() {
+		t.Fatalf("same content gave ids %s and %s", a.Hash(), b.Hash())
+	}
+
+	got := r.Object(a.Hash())
+	if want := append(a.Names(), b.Names()...); !equal(got.Names(), want) {
+		t.Errorf("Names: got %v, want %v", got.Names(), want)
+	}
+	if !equal(got.Tags(), []string{"one", "two"}) {
+		t.Errorf("Tags: got %v, want [one two]", got.Tags())
+	}
+	s, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Objects != 1 || s.Names != 2 || s.Chunks != single.Chunks || s.CompressedSize != single.CompressedSize {
+		t.Errorf("Stats: got %+v with two names, %+v with one", s, single)
+	}
+}
+
+// collider claims the id of another object for different content
+type collider struct {
+	storage.Object
+	id storage.ID
+}
+
+func (c collider) Hash() storage.ID { return c.id }
+
+func checkCollision(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(4, 10<<10)
+	o := f.add(r, "a/first", data)
+	other := f.object("b/second", content(5, 20<<10))
+
+	if err := r.Add(collider{other, o.Hash()}); err == nil {
+		t.Fatal("Add: no error for an id already stored with another size")
+	}
+	got := r.Object(o.Hash())
+	if got == nil || got.Size() != uint64(len(data)) || !equal(got.Names(), o.Names()) {
+		t.Fatal("Add: a collision changed the stored object")
+	}
+	if found := r.ObjectsByName(other.Names()[0]); len(found) != 0 {
+		t.Errorf("ObjectsByName: the colliding name was recorded")
+	}
+	if string(readAll(t, got)) != string(data) {
+		t.Error("WriteData: a collision changed the stored content")
+	}
+}
+
+func checkRemove(t *testing.T, r storage.Repository, f *fixture) {
+	keep := content(6, 50<<10)
+	a := f.add(r, "x/a", content(7, 50<<10))
+	b := f.add(r, "x/b", keep)
+
+	if err := r.Remove(a.Hash()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if r.Has(a.Hash()) || r.Object(a.Hash()) != nil {
+		t.Error("the removed object is still there")
+	}
+	if found := r.ObjectsByName(a.Names()[0]); len(found) != 0 {
+		t.Errorf("ObjectsByName: the removed name still gives %v", ids(found))
+	}
+	if found := ids(r.ObjectsByTag("x")); !equal(found, []string{b.Hash().String()}) {
+		t.Errorf("ObjectsByTag: got %v after Remove", found)
+	}
+	if string(readAll(t, r.Object(b.Hash()))) != string(keep) {
+		t.Error("Remove: changed the content of another object")
+	}
+	s, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Objects != 1 || s.Names != 1 || s.Size != uint64(len(keep)) {
+		t.Errorf("Stats: got %+v after Remove", s)
+	}
+	if err = r.Remove(a.Hash()); err == nil {
+		t.Error("Remove: no error for an object already removed")
+	}
+
+	// content added again after removal is stored afresh
+	again := f.add(r, "x/a", content(7, 50<<10))
+	if string(readAll(t, r.Object(again.Hash()))) != string(content(7, 50<<10)) {
+		t.Error("WriteData: content added after removal differs")
+	}
+}
+
+func checkConcurrentAdds(t *testing.T, r storage.Repository, f *fixture) {
+	const workers, each = 8, 4
+	shared := content(8, 20<<10)
+
+	// objects are made up front, since the fixture fails from this
+	// goroutine only
+	objects := make([][]storage.Object, workers)
+	for w := range objects {
+		for i := 0; i < each; i++ {
+			objects[w] = append(objects[w], f.object(fmt.Sprintf("w%d/%d", w, i), content(int64(100+w*each+i), 20<<10)))
+		}
+		objects[w] = append(objects[w], f.object(fmt.Sprintf("w%d/shared", w), shared))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*(each+1))
+	for w := range objects {
+		wg.Add(1)
+		go func(list []storage.Object) {
+			defer wg.Done()
+			for _, o := range list {
+				if err := r.Add(o); err != nil {
+					errs <- err
+				}
+			}
+		}(objects[w])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Add: %v", err)
+	}
+
+	s, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Objects != workers*each+1 || s.Names != workers*(each+1) {
+		t.Errorf("Stats: got %+v, want %d objects and %d names", s, workers*each+1, workers*(each+1))
+	}
+	if got := r.Object(objects[0][each].Hash()); got == nil || len(got.Names()) != workers {
+		t.Errorf("the shared content should have %d names", workers)
+	}
+}
+
+func checkLargeObject(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(9, 12<<20+12345)
+	o := f.add(r, "big/file", data)
+
+	got := r.Object(o.Hash())
+	if got == nil {
+		t.Fatal("Object: nil after Add")
+	}
+	if len(got.Chunks()) < 2 {
+		t.Errorf("Chunks: %d chunk(s) for %d bytes", len(got.Chunks()), len(data))
+	}
+	var total uint64
+	for _, c := range got.Chunks() {
+		total += c.Size
+	}
+	if total != uint64(len(data)) || got.Size() != uint64(len(data)) {
+		t.Errorf("Size: got %d, chunks add up to %d, want %d", got.Size(), total, len(data))
+	}
+	if string(readAll(t, got)) != string(data) {
+		t.Error("WriteData: content differs from what was added")
+	}
+}
+
+func checkIterate(t *testing.T, r storage.Repository, f *fixture) {
+	want := []string{}
+	for i := 0; i < 3; i++ {
+		want = append(want, f.add(r, fmt.Sprintf("it/%d", i), content(int64(200+i), 1<<10)).Hash().String())
+	}
+
+	seen := []string{}
+	if err := r.Iterate(func(o storage.Object) error {
+		seen = append(seen, o.Hash().String())
+		return nil
+	}); err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if !equal(seen, want) {
+		t.Errorf("Iterate: got %v, want %v", seen, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	if err := r.Iterate(func(storage.Object) error { calls++; return stop }); err != stop || calls != 1 {
+		t.Errorf("Iterate: %d call(s) and %v, want 1 call and the error of fn", calls, err)
+	}
+
+	// fn may change the repository as it goes
+	if err := r.Iterate(func(o storage.Object) error { return r.Remove(o.Hash()) }); err != nil {
+		t.Fatalf("Iterate removing each object: %v", err)
+	}
+	if s, err := r.Stats(); err != nil || s.Objects != 0 {
+		t.Errorf("Stats: got %+v, %v after removing every object", s, err)
+	}
+}
+
+func checkFind(t *testing.T, r storage.Repository, f *fixture) {
+	jpg := f.add(r, "photos/2019/a.jpg", content(10, 200<<10))
+	thumb := f.add(r, "photos/thumbs/a.jpg", content(11, 1<<10))
+	doc := f.add(r, "docs/a.txt", content(12, 2<<10))
+
+	for _, c := range []struct {
+		query string
+		want  []storage.Object
+	}{
+		{"tag:photos", []storage.Object{jpg, thumb}},
+		{"tag:photos AND NOT tag:thumbs", []storage.Object{jpg}},
+		{"name:*.jpg AND size>100k", []storage.Object{jpg}},
+		{"name:*.txt OR (tag:thumbs size<=1k)", []storage.Object{thumb, doc}},
+		{"NOT name:*.jpg", []storage.Object{doc}},
+		{"tag:nothing", nil},
+	} {
+		q, err := storage.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := r.Find(q)
+		if err != nil {
+			t.Errorf("Find(%s): %v", c.query, err)
+			continue
+		}
+		if got, want := ids(found), ids(c.want); !equal(got, want) {
+			t.Errorf("Find(%s): got %v, want %v", c.query, got, want)
+		}
+	}
+}
+
+func checkFindTagOfName(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(14, 200<<10)
+	photo := f.add(r, "photos/2019/a.bin", data)
+	doc := f.add(r, "docs/a.bin", data)
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"tag:docs AND size>100k", doc.Names()},
+		{"tag:2019", photo.Names()},
+		{"NOT tag:photos", doc.Names()},
+	} {
+		q, err := storage.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := r.Find(q)
+		if err != nil {
+			t.Errorf("Find(%s): %v", c.query, err)
+			continue
+		}
+		var names []string
+		for _, o := range found {
+			for _, name := range o.Names() {
+				if q.Match(o, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		if !equal(names, c.want) {
+			t.Errorf("Find(%s): matched %v, want %v", c.query, names, c.want)
+		}
+	}
+}
+
+func checkCanonical(t *testing.T, r storage.Repository, f *fixture) {
+	data := content(13, 1<<10)
+	a := f.add(r, "c/a", data)
+	b := f.add(r, "c/b", data)
+	name := b.Names()[0]
+
+	if err := r.SetCanonical(a.Hash(), name); err != nil {
+		t.Fatalf("SetCanonical: %v", err)
+	}
+	if got := r.Object(a.Hash()).Canonical(); got != name {
+		t.Errorf("Canonical: got %q, want %q", got, name)
+	}
+	if err := r.SetCanonical(a.Hash(), "no/such/name"); err == nil {
+		t.Error("SetCanonical: no error for a name the object lacks")
+	}
+	if err := r.SetCanonical(missing, name); err == nil {
+		t.Error("SetCanonical: no error for an unknown object")
+	}
+	if got := r.Object(a.Hash()).Canonical(); got != name {
+		t.Errorf("Canonical: a failed SetCanonical changed it to %q", got)
+	}
+}
+
+func checkSnapshots(t *testing.T, r storage.Repository, f *fixture) {
+	o := f.add(r, "s/a", content(14, 1<<10))
+	first, err := storage.NewSnapshot([]string{f.root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Time = first.Time.Add(-time.Hour)
+	first.Tags = []string{"nightly"}
+	first.Files[o.Names()[0]] = o.Hash()
+	second, err := storage.NewSnapshot([]string{f.root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []storage.Snapshot{second, first} {
+		if err = r.AddSnapshot(s); err != nil {
+			t.Fatalf("AddSnapshot: %v", err)
+		}
+	}
+
+	snaps, err := r.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].ID != first.ID || snaps[1].ID != second.ID {
+		t.Fatalf("Snapshots: got %v, want %s then %s", snaps, first.ID, second.ID)
+	}
+	got, err := r.Snapshot(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Files) != 1 || got.Files[o.Names()[0]] != o.Hash() || !got.HasTag("nightly") {
+		t.Errorf("Snapshot: got files %v and tags %v", got.Files, got.Tags)
+	}
+	got.Files["changed"] = missing
+	if again, _ := r.Snapshot(first.ID); len(again.Files) != 1 {
+		t.Error("Snapshot: changing a returned snapshot changed the stored one")
+	}
+
+	if err = r.ForgetSnapshot(first.ID); err != nil {
+		t.Fatalf("ForgetSnapshot: %v", err)
+	}
+	if _, err = r.Snapshot(first.ID); err == nil {
+		t.Error("Snapshot: no error for a forgotten snapshot")
+	}
+	if err = r.ForgetSnapshot(first.ID); err == nil {
+		t.Error("ForgetSnapshot: no error for a forgotten snapshot")
+	}
+	if !r.Has(o.Hash()) {
+		t.Error("ForgetSnapshot: removed an object")
+	}
+}
+
+func checkStatCache(t *testing.T, r storage.Repository, f *fixture) {
+	cache, ok := r.(storage.StatCache)
+	if !ok {
+		t.Skip("repository has no stat cache")
+	}
+	o := f.add(r, "sc/a", content(17, 1<<10))
+	name := o.Names()[0]
+	st := storage.FileStat{Device: 1, Inode: 1 << 63, Size: 1 << 10, ModTime: 100, ChangeTime: 200}
+
+	if _, ok := cache.CachedID(name, st); ok {
+		t.Error("CachedID: a hit before anything was cached")
+	}
+	if err := cache.CacheStat(name, st, o.Hash()); err != nil {
+		t.Fatalf("CacheStat: %v", err)
+	}
+	if id, ok := cache.CachedID(name, st); !ok || id != o.Hash() {
+		t.Errorf("CachedID: got %s, %t, want %s", id, ok, o.Hash())
+	}
+	changed := st
+	changed.ChangeTime++
+	if _, ok := cache.CachedID(name, changed); ok {
+		t.Error("CachedID: a hit for a changed stat")
+	}
+	if _, ok := cache.CachedID("sc/other", st); ok {
+		t.Error("CachedID: a hit for another name")
+	}
+
+	// a later read replaces the entry
+	b := f.add(r, "sc/a", content(18, 1<<10))
+	if err := cache.CacheStat(name, changed, b.Hash()); err != nil {
+		t.Fatalf("CacheStat: %v", err)
+	}
+	if id, ok := cache.CachedID(name, changed); !ok || id != b.Hash() {
+		t.Errorf("CachedID: got %s, %t after a second CacheStat, want %s", id, ok, b.Hash())
+	}
+	if _, ok := cache.CachedID(name, st); ok {
+		t.Error("CachedID: the replaced stat still hits")
+	}
+
+	// the entry goes with its object
+	if err := r.Remove(b.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.CachedID(name, changed); ok {
+		t.Error("CachedID: a hit for a removed object")
+	}
+}
+
+func checkErrors(t *testing.T, r storage.Repository, f *fixture) {
+	if err := r.AddFile(f.root+"/no/such/file", f.root); err == nil {
+		t.Error("AddFile: no error for a missing file")
+	}
+	if err := r.Remove(missing); err == nil {
+		t.Error("Remove: no error for an unknown object")
+	}
+	if _, err := r.Snapshot("nonexistent"); err == nil {
+		t.Error("Snapshot: no error for an unknown snapshot")
+	}
+	if s, err := r.Stats(); err != nil || s != (storage.Stats{}) {
+		t.Errorf("Stats: got %+v, %v after failed calls", s, err)
+	}
+
+	// errors leave the repository usable
+	o := f.add(r, "after/errors", content(15, 1<<10))
+	if !r.Has(o.Hash()) {
+		t.Error("Has: false for an object added after errors")
+	}
+}
@@ -0,0 +1,158 @@
+// Package storagetest checks that a storage.Repository behaves the way the
+// rest of consolidate relies on, whichever backend keeps the data. A
+// backend runs it from a test of its own:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Repository {
+//			r, err := factory.Registry.Open("sqlite://" + t.TempDir() + "/test.db")
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return r
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+// Factory returns a new, empty repository; Run calls it once per check
+type Factory func(t *testing.T) storage.Repository
+
+// Records is implemented by a backend that can count what it keeps for an
+// object without merging repeats, so that checks see duplicates its reads
+// would hide. A backend may implement it in its test files alone
+type Records interface {
+	// Records counts the "names", "tags" or "entries" kept for id
+	Records(kind string, id storage.ID) (int, error)
+}
+
+// Run checks every behaviour in turn, each as a subtest on a repository of
+// its own
+func Run(t *testing.T, fn Factory) {
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			r := fn(t)
+			if r == nil {
+				t.Fatal("factory returned no repository")
+			}
+			c.run(t, r, newFixture(t, r))
+		})
+	}
+}
+
+// fixture makes files under a temporary root and turns them into objects
+// the way AddFile would
+type fixture struct {
+	t    *testing.T
+	root string
+	opts storage.Options
+}
+
+func newFixture(t *testing.T, r storage.Repository) *fixture {
+	opts := storage.DefaultOptions()
+	opts.Hash = r.HashAlgorithm()
+	if e, ok := r.(storage.Encryptable); ok {
+		opts.Key = e.Key()
+	}
+	return &fixture{t: t, root: t.TempDir(), opts: opts}
+}
+
+// file writes data to name under the root and returns its path
+func (f *fixture) file(name string, data []byte) string {
+	f.t.Helper()
+	file := filepath.Join(f.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	return file
+}
+
+// object writes data to name and reads it back as an object; folders in
+// name become its tags
+func (f *fixture) object(name string, data []byte) storage.Object {
+	f.t.Helper()
+	o, err := storage.NewObject(f.file(name, data), f.root, f.opts)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { _ = o.Close() })
+	return o
+}
+
+// add stores an object made by object and fails the check on error
+func (f *fixture) add(r storage.Repository, name string, data []byte) storage.Object {
+	f.t.Helper()
+	o := f.object(name, data)
+	if err := r.Add(o); err != nil {
+		f.t.Fatalf("Add(%s): %v", name, err)
+	}
+	return o
+}
+
+// content returns n bytes that are the same for the same seed
+func content(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// readAll returns the content of o as it was added
+func readAll(t *testing.T, o storage.Object) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := o.WriteData(&buf, true); err != nil {
+		t.Fatalf("WriteData(%s): %v", o.Hash(), err)
+	}
+	return buf.Bytes()
+}
+
+// sorted returns a sorted copy of list
+func sorted(list []string) []string {
+	s := append([]string{}, list...)
+	sort.Strings(s)
+	return s
+}
+
+func equal(a, b []string) bool {
+	a, b = sorted(a), sorted(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ids returns the ids of objects
+func ids(objects []storage.Object) []string {
+	list := []string{}
+	for _, o := range objects {
+		list = append(list, o.Hash().String())
+	}
+	return list
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// Verify reads every chunk of o back, unsealed and inflated, and checks
+// it against the id and size it was stored under, then checks the whole
+// content against the id of o. opts must name the hash and key of the
+// repository o came from
+func Verify(o Object, opts Options) error {
+	whole, err := opts.newHash()
+	if err != nil {
+		return err
+	}
+	var total uint64
+	for i, c := range o.Chunks() {
+		h, err := opts.newHash()
+		if err != nil {
+			return err
+		}
+		var n byteCount
+		if err = writeChunk(o, i, io.MultiWriter(h, whole, &n), true, opts.Key); err != nil {
+			return fmt.Errorf("chunk %s: %v", c.ID, err)
+		}
+		if uint64(n) != c.Size {
+			return fmt.Errorf("chunk %s: read %d bytes, want %d", c.ID, n, c.Size)
+		}
+		if id := NewID(h.Sum(nil)); id != c.ID {
+			return fmt.Errorf("chunk %s: content hashes to %s", c.ID, id)
+		}
+		total += c.Size
+	}
+	if total != o.Size() {
+		return fmt.Errorf("chunks hold %d bytes, want %d", total, o.Size())
+	}
+	if id := NewID(whole.Sum(nil)); id != o.Hash() {
+		return fmt.Errorf("content hashes to %s", id)
+	}
+	return nil
+}
+
+// byteCount is a writer that only counts what it is given
+type byteCount uint64
+
+func (n *byteCount) Write(p []byte) (int, error) {
+	*n += byteCount(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of file, or nil if it has
+// none or they cannot be read
+func readXattrs(file string) map[string][]byte {
+	size, err := syscall.Listxattr(file, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(file, list); err != nil {
+		return nil
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := syscall.Getxattr(file, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(file, string(name), value); err != nil {
+			continue
+		}
+		attrs[string(name)] = value[:n]
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	return attrs
+}
+
+// writeXattrs sets attrs on file; attributes the process may not set,
+// or the filesystem does not support, are skipped
+func writeXattrs(file string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		err := syscall.Setxattr(file, name, value, 0)
+		if err != nil && err != syscall.EPERM && err != syscall.ENOTSUP && err != syscall.EACCES {
+			return err
+		}
+	}
+	return nil
+}
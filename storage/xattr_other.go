@@ -0,0 +1,7 @@
+//go:build !linux
+
+package storage
+
+func readXattrs(file string) map[string][]byte { return nil }
+
+func writeXattrs(file string, attrs map[string][]byte) error { return nil }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/johnweldon/consolidate/storage"
+)
+
+func verifyMain(c *cli.Context) error {
+	repo, err := openRepository(c)
+	if err != nil {
+		return err
+	}
+	opts := storage.DefaultOptions()
+	opts.Hash = repo.HashAlgorithm()
+	if enc, ok := repo.(storage.Encryptable); ok {
+		opts.Key = enc.Key()
+	}
+	verbose := c.GlobalBool("verbose")
+
+	objects, damaged := 0, 0
+	err = repo.Iterate(func(obj storage.Object) error {
+		objects++
+		if err := storage.Verify(obj, opts); err != nil {
+			damaged++
+			fmt.Printf("damaged %s: %v (%s)\n", obj.Hash(), err, strings.Join(obj.Names(), ", "))
+		} else if verbose {
+			fmt.Printf("ok %s\n", obj.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, s := range snaps {
+		snap, err := repo.Snapshot(s.ID)
+		if err != nil {
+			return err
+		}
+		for _, name := range snap.Names() {
+			if id := snap.Files[name]; !repo.Has(id) {
+				missing++
+				fmt.Printf("missing %s: %s in snapshot %s\n", id, name, snap.ID)
+			}
+		}
+	}
+
+	fmt.Printf("%d object(s), %d snapshot(s): %d damaged, %d missing\n", objects, len(snaps), damaged, missing)
+	if damaged > 0 || missing > 0 {
+		return cli.NewExitError("repository is damaged", exitDamaged)
+	}
+	return nil
+}